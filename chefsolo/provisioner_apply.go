@@ -14,6 +14,7 @@ const (
 	clienrb        = "client.rb"
 	defaultEnv     = "_default"
 	logfileDir     = "logfiles"
+	secretKey      = "encrypted_data_bag_secret"
 	linuxChefCmd   = "/usr/bin/chef-client"
 	linuxConfDir   = "/opt/chef/0"
 	windowsChefCmd = "cmd /c chef-client"
@@ -21,27 +22,29 @@ const (
 	maxBufSize     = 8 * 1024
 )
 
+// Every value is written with rubyQuote, client.rb is Ruby code. Only the
+// client_options are inserted as they are, being Ruby lines themselves.
 const clientConf = `
 log_location            STDOUT
 {{ if .HTTPProxy }}
-http_proxy          "{{ .HTTPProxy }}"
-ENV['http_proxy'] = "{{ .HTTPProxy }}"
-ENV['HTTP_PROXY'] = "{{ .HTTPProxy }}"
+http_proxy          {{ ruby .HTTPProxy }}
+ENV['http_proxy'] = {{ ruby .HTTPProxy }}
+ENV['HTTP_PROXY'] = {{ ruby .HTTPProxy }}
 {{ end -}}
 
 {{ if .HTTPSProxy }}
-https_proxy          "{{ .HTTPSProxy }}"
-ENV['https_proxy'] = "{{ .HTTPSProxy }}"
-ENV['HTTPS_PROXY'] = "{{ .HTTPSProxy }}"
+https_proxy          {{ ruby .HTTPSProxy }}
+ENV['https_proxy'] = {{ ruby .HTTPSProxy }}
+ENV['HTTPS_PROXY'] = {{ ruby .HTTPSProxy }}
 {{ end -}}
 
 {{ if .NOProxy }}
-no_proxy          "{{ join .NOProxy "," }}"
-ENV['no_proxy'] = "{{ join .NOProxy "," }}"
+no_proxy          {{ join .NOProxy "," | ruby }}
+ENV['no_proxy'] = {{ join .NOProxy "," | ruby }}
 {{ end -}}
 
 {{ if .SSLVerifyMode }}
-ssl_verify_mode  {{ .SSLVerifyMode }}
+ssl_verify_mode  {{ rubySymbol .SSLVerifyMode }}
 {{- end -}}
 
 {{ if .ClientOptions }}
@@ -49,17 +52,26 @@ ssl_verify_mode  {{ .SSLVerifyMode }}
 {{ end }}
 
 local_mode true
+{{ if .FileCachePath -}}
+file_cache_path {{ ruby .FileCachePath }}
+{{ end -}}
+{{ if .FileBackupPath -}}
+file_backup_path {{ ruby .FileBackupPath }}
+{{ end -}}
+{{ if .SecretKey -}}
+encrypted_data_bag_secret {{ printf "%s/encrypted_data_bag_secret" .DefaultConfDir | ruby }}
+{{ end -}}
 {{ if not .UsePolicyfile }}
-cookbook_path '{{ .DefaultConfDir }}/{{ .BaseOutputDir }}/cookbooks'
+cookbook_path {{ printf "%s/%s/cookbooks" .DefaultConfDir .BaseOutputDir | ruby }}
 {{ end }}
-node_path '{{ .DefaultConfDir }}/{{ .BaseOutputDir }}/nodes'
-role_path '{{ .DefaultConfDir }}/{{ .BaseOutputDir }}/roles'
-data_bag_path '{{ .DefaultConfDir }}/{{ .BaseOutputDir }}/data_bags'
-environment_path '{{ .DefaultConfDir }}/{{ .BaseOutputDir }}/environments'
+node_path {{ printf "%s/%s/nodes" .DefaultConfDir .BaseOutputDir | ruby }}
+role_path {{ printf "%s/%s/roles" .DefaultConfDir .BaseOutputDir | ruby }}
+data_bag_path {{ printf "%s/%s/data_bags" .DefaultConfDir .BaseOutputDir | ruby }}
+environment_path {{ printf "%s/%s/environments" .DefaultConfDir .BaseOutputDir | ruby }}
 `
 
-type provisionFn func(terraform.UIOutput, communicator.Communicator) error
-type installFn func(terraform.UIOutput, communicator.Communicator, string) error
+type provisionFn func(context.Context, terraform.UIOutput, communicator.Communicator) error
+type installFn func(context.Context, terraform.UIOutput, communicator.Communicator, string) error
 
 func applyFn(ctx context.Context) error {
 	o := ctx.Value(schema.ProvOutputKey).(terraform.UIOutput)
@@ -80,44 +92,68 @@ func applyFn(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer comm.Disconnect()
+
+	release, err := p.joinWorkspace(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	o.Output("Creating configuration files...")
-	if err := p.prepareConfigFiles(ctx, o, comm, p.DefaultConfDir); err != nil {
+	if err := p.prepareConfigFiles(ctx, p.output(o, "bundle"), comm, p.DefaultConfDir); err != nil {
 		return err
 	}
 
 	o.Output("Preparing the machine...")
-	if err := p.prepareMachine(o, comm, p.DefaultConfDir); err != nil {
+	if err := p.prepareMachine(ctx, o, comm, p.DefaultConfDir); err != nil {
 		return err
 	}
 
-	o.Output("Starting initial Chef-Client run...")
-	if err := p.runChefClient(o, comm); err != nil {
-		return err
+	run := p.runChefClient
+	if p.WhyRun {
+		o.Output("Starting Chef-Client why-run...")
+		run = p.runWhyRun
+	} else {
+		o.Output("Starting initial Chef-Client run...")
 	}
-	return nil
+	return p.inPhase(ctx, o, comm, "chef-client run", p.RunTimeout, func(ctx context.Context) error {
+		return run(ctx, p.output(o, "chef"), comm)
+	})
 }
 
 func (p *provisioner) runChefClientFunc(chefCmd string, confDir string) provisionFn {
-	return func(o terraform.UIOutput, comm communicator.Communicator) error {
-		var cmd = fmt.Sprintf("%s -z -c %s -j %q",
+	return func(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator) error {
+		var cmd = fmt.Sprintf("%s -z -c %s -j %s",
 			chefCmd,
-			path.Join(confDir, clienrb),
-			path.Join(confDir, p.BaseOutputDir, "dna", p.InstanceId+".json"))
+			p.quote(path.Join(confDir, clienrb)),
+			p.quote(path.Join(confDir, p.BaseOutputDir, "dna", p.InstanceId+".json")))
 
 		switch {
 		case p.UsePolicyfile && p.NamedRunList == "":
-			cmd = fmt.Sprintf(cmd)
 		case p.UsePolicyfile && p.NamedRunList != "":
-			cmd = fmt.Sprintf("%s -n %q", cmd, p.NamedRunList)
+			cmd = fmt.Sprintf("%s -n %s", cmd, p.quote(p.NamedRunList))
 		default:
-			cmd = fmt.Sprintf("%s -E %q", cmd, p.Environment)
+			cmd = fmt.Sprintf("%s -E %s", cmd, p.quote(p.Environment))
+		}
+		cmd += p.licenseArgs()
+		if p.WhyRun {
+			// The pending changes are read from the doc formatter, which
+			// chef-client only picks by itself on a terminal
+			cmd += " --why-run --force-formatter -F doc"
 		}
 		if p.installAsService {
-			if err := p.installService(o, comm, cmd); err != nil {
+			if err := p.installService(ctx, o, comm, cmd); err != nil {
 				return err
 			}
 		}
-		return p.runRemote(o, comm, fmt.Sprintf("cd %s && %s", path.Join(confDir, p.BaseOutputDir), cmd))
+		dir := p.quote(path.Join(confDir, p.BaseOutputDir))
+		if p.OSType == "windows" {
+			return p.runLocked(ctx, o, comm, fmt.Sprintf("cd %s && %s", dir, cmd))
+		}
+		// exec keeps the pid written by the shell, which is used to stop
+		// chef-client when the apply is interrupted
+		return p.runLocked(ctx, o, comm, fmt.Sprintf("cd %s && echo $$ > %s && exec %s",
+			dir, shellQuote(path.Join(confDir, chefPidFile)), cmd))
 	}
 }
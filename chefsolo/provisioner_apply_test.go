@@ -1,11 +1,15 @@
 package chefsolo
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/spf13/afero"
@@ -27,6 +31,8 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 		ChefCmd  string
 		ConfDir  string
 		Commands map[string]bool
+		Uploads  map[string]string
+		Stdin    string
 	}{
 		"Sudo": {
 			Config: map[string]interface{}{
@@ -44,7 +50,7 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 			ConfDir: "/",
 
 			Commands: map[string]bool{
-				fmt.Sprintf(`sudo bash -c 'cd %s && %s -z -c %s -j %q -E %q'`,
+				fmt.Sprintf(`sudo bash -c '`+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s'`,
 					path.Join("/", "output"),
 					linuxChefCmd,
 					path.Join("/", clienrb),
@@ -68,7 +74,7 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 			ConfDir: "/",
 
 			Commands: map[string]bool{
-				fmt.Sprintf(`cd %s && %s -z -c %s -j %q -E %q`,
+				fmt.Sprintf(testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s`,
 					path.Join("/", "output"),
 					linuxChefCmd,
 					path.Join("/", clienrb),
@@ -93,7 +99,7 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 			ConfDir: "/",
 
 			Commands: map[string]bool{
-				fmt.Sprintf(`cd %s && %s -z -c %s -j %q -E %q`,
+				fmt.Sprintf(testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s`,
 					path.Join("/", "output"),
 					linuxChefCmd,
 					path.Join("/", clienrb),
@@ -120,7 +126,7 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 			ConfDir: "/",
 
 			Commands: map[string]bool{
-				fmt.Sprintf(`cd %s && %s -z -c %s -j %q -n %q`,
+				fmt.Sprintf(testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -n %s`,
 					path.Join("/", "output"),
 					linuxChefCmd,
 					path.Join("/", clienrb),
@@ -128,13 +134,216 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 					"tototo"): true,
 			},
 		},
+		"PreventSudo": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"prevent_sudo":     true,
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+		},
+		"SudoUser": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"privilege_user":   "chef",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`sudo -u chef bash -c '`+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s'`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+		},
+		"SudoPassword": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []string{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "sudo_password",
+				"privilege_password":   "s3cr3t",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`sudo -k -S -p '' bash -c 'exec < /dev/null; `+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s'`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+			Stdin: "s3cr3t\n",
+		},
+		"Su": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []string{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "su",
+				"privilege_user":       "chef",
+				"privilege_password":   "s3cr3t",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`su -s /bin/bash chef -c 'exec < /dev/null; `+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s'`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+			Stdin: "s3cr3t\n",
+		},
+		"Doas": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []string{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "doas",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`doas sh -c '`+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s'`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+		},
+		"License": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"chef_license":     "accept-silent",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`sudo bash -c '`+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s --chef-license accept-silent'`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+		},
+		"CincLicense": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         false,
+				"distribution":     "cinc",
+				"chef_license":     "accept",
+			},
+
+			ChefCmd: "/usr/bin/cinc-client",
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E %s`,
+					path.Join("/", "output"),
+					"/usr/bin/cinc-client",
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json"),
+					defaultEnv): true,
+			},
+		},
+		"HostileEnvironment": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"environment":      "it's $(id)",
+			},
+
+			ChefCmd: linuxChefCmd,
+
+			ConfDir: "/",
+
+			Commands: map[string]bool{
+				fmt.Sprintf(`sudo bash -c '`+testLockPrefix+`cd %s && echo $$ > /chef-client.pid && exec %s -z -c %s -j %s -E '\''it'\''\'\'''\''s $(id)'\'''`,
+					path.Join("/", "output"),
+					linuxChefCmd,
+					path.Join("/", clienrb),
+					path.Join("/", "output", "dna", "toto.json")): true,
+			},
+		},
 	}
 
 	o := new(terraform.MockUIOutput)
 	c := new(communicator.MockCommunicator)
 
 	for k, tc := range cases {
-		c.Commands = tc.Commands
+		stdin := ""
+		commandFunc := stagingCommandFunc(tc.Commands)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			if cmd.Stdin != nil {
+				b, _ := ioutil.ReadAll(cmd.Stdin)
+				stdin = string(b)
+			}
+			return commandFunc(cmd)
+		}
+		c.Uploads = tc.Uploads
 
 		os := afero.NewMemMapFs()
 		os.MkdirAll("/input", 766)
@@ -149,9 +358,45 @@ func TestResourceProvider_runChefClient(t *testing.T) {
 		}
 		p.runChefClient = p.runChefClientFunc(tc.ChefCmd, tc.ConfDir)
 
-		err = p.runChefClient(o, c)
+		err = p.runChefClient(context.Background(), o, c)
 		if err != nil {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
+		if stdin != tc.Stdin {
+			t.Fatalf("Test %q failed: expected %q on stdin, got %q", k, tc.Stdin, stdin)
+		}
+	}
+}
+
+func TestResourceProvider_uploadClientConf(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output/it's`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"bundle_id":        "app",
+		"http_proxy":       `http://proxy.local/"#{` + "`id`" + `}`,
+		"no_proxy":         []interface{}{`local\`, "'"},
+		"ssl_verify_mode":  "verify_peer",
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p := testProvisioner(t, fs, config)
+
+	c := &uploadCommunicator{uploaded: make(map[string][]byte)}
+	if err := p.uploadClientConf(c, linuxConfDir); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	content := string(c.uploaded[path.Join(linuxConfDir, clienrb)])
+	for _, expected := range []string{
+		"http_proxy          'http://proxy.local/\"#{`id`}'\n",
+		`ENV['no_proxy'] = 'local\\,\''` + "\n",
+		"ssl_verify_mode  :verify_peer\n",
+		`node_path '` + p.DefaultConfDir + `/it\'s/nodes'` + "\n",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("%q is missing from client.rb:\n%s", expected, content)
+		}
 	}
 }
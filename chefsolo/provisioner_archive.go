@@ -0,0 +1,417 @@
+package chefsolo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	uploadModeDirectory = "directory"
+	uploadModeArchive   = "archive"
+	uploadModeSync      = "sync"
+	compressionGzip     = "gzip"
+	compressionXz       = "xz"
+)
+
+// archiveEntry is a local directory and the name it gets within the archive
+type archiveEntry struct {
+	src  string
+	name string
+}
+
+// archiveEntries returns the output directory and the resources to bundle,
+// laid out the same way uploadDirectory would upload them
+func (p *provisioner) archiveEntries(o terraform.UIOutput) []archiveEntry {
+	entries := []archiveEntry{{p.OutputDir, p.BaseOutputDir}}
+	for _, resource := range p.Resources {
+		src := resource.(string)
+		if _, err := p.os.Stat(src); err != nil {
+			o.Output("Warning: " + src + " does not exist, uploading nothing.")
+			continue
+		}
+		entries = append(entries, archiveEntry{src, path.Join(p.BaseOutputDir, filepath.Base(src))})
+	}
+	return entries
+}
+
+// archiveWriter abstracts the archive formats the bundle can be shipped in
+type archiveWriter interface {
+	writeDir(name string, info os.FileInfo) error
+	writeFile(name string, info os.FileInfo, r io.Reader) error
+	writeSymlink(name, target string, info os.FileInfo) error
+	// keepsSymlinks is false when the format can not store symlinks
+	keepsSymlinks() bool
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	cw io.WriteCloser
+}
+
+func (a *tarArchiveWriter) writeDir(name string, info os.FileInfo) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Name:     name + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  info.ModTime(),
+	})
+}
+
+func (a *tarArchiveWriter) writeFile(name string, info os.FileInfo, r io.Reader) error {
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Linkname: target,
+		Typeflag: tar.TypeSymlink,
+		Mode:     0777,
+		ModTime:  info.ModTime(),
+	})
+}
+
+func (a *tarArchiveWriter) keepsSymlinks() bool {
+	return true
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.cw.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) writeDir(name string, info os.FileInfo) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name + "/"
+	_, err = a.zw.CreateHeader(h)
+	return err
+}
+
+func (a *zipArchiveWriter) writeFile(name string, info os.FileInfo, r io.Reader) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	h.Method = zip.Deflate
+	w, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	return fmt.Errorf("zip archives can not store symlinks")
+}
+
+// Expand-Archive knows nothing about symlinks, so they always get followed
+func (a *zipArchiveWriter) keepsSymlinks() bool {
+	return false
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// archiveExtension returns the extension of the archive built with the
+// configured compression, zip being used for windows
+func (p *provisioner) archiveExtension() string {
+	switch {
+	case p.OSType == "windows":
+		return ".zip"
+	case p.ArchiveCompression == compressionXz:
+		return ".tar.xz"
+	}
+	return ".tar.gz"
+}
+
+func (p *provisioner) newArchiveWriter(w io.Writer) (archiveWriter, error) {
+	switch p.archiveExtension() {
+	case ".zip":
+		return &zipArchiveWriter{zip.NewWriter(w)}, nil
+	case ".tar.xz":
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("error creating xz writer: %v", err)
+		}
+		return &tarArchiveWriter{tar.NewWriter(xw), xw}, nil
+	}
+	gw := gzip.NewWriter(w)
+	return &tarArchiveWriter{tar.NewWriter(gw), gw}, nil
+}
+
+// buildArchive writes a compressed archive of the entries to w, restricted to
+// the files to sync along with their manifest when sync is set
+func (p *provisioner) buildArchive(w io.Writer, entries []archiveEntry, sync *bundleSync) error {
+	aw, err := p.newArchiveWriter(w)
+	if err != nil {
+		return err
+	}
+	bundle := aw
+	if sync != nil {
+		bundle = &syncArchiveWriter{archiveWriter: aw, sync: sync, prefix: p.BaseOutputDir + "/"}
+	}
+	for _, entry := range entries {
+		root, err := filepath.Abs(entry.src)
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %v", entry.src, err)
+		}
+		if err := p.archiveTree(bundle, root, root, entry.name, map[string]bool{}); err != nil {
+			return err
+		}
+	}
+	if sync != nil {
+		content := sync.manifest.String()
+		info := &generatedFileInfo{name: manifestFile, size: int64(len(content)), modTime: time.Now()}
+		if err := aw.writeFile(path.Join(p.BaseOutputDir, manifestFile), info, strings.NewReader(content)); err != nil {
+			return fmt.Errorf("error archiving %s: %v", manifestFile, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("error closing archive: %v", err)
+	}
+	return nil
+}
+
+// archiveTree adds the src tree to the archive under name. Symlinks pointing
+// within root are kept as they are when the format allows it, the other ones
+// are replaced by what they point to as their target would not exist on the
+// remote machine.
+func (p *provisioner) archiveTree(aw archiveWriter, root, src, name string, visited map[string]bool) error {
+	visited[src] = true
+	defer delete(visited, src)
+
+	return afero.Walk(p.os, src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		entryName := path.Join(name, filepath.ToSlash(rel))
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := readlink(p.os, file)
+			if err != nil {
+				return fmt.Errorf("error reading symlink %s: %v", file, err)
+			}
+			resolved := target
+			if !filepath.IsAbs(resolved) {
+				resolved = filepath.Join(filepath.Dir(file), resolved)
+			}
+			if aw.keepsSymlinks() && !filepath.IsAbs(target) && isWithin(root, resolved) {
+				if err := aw.writeSymlink(entryName, filepath.ToSlash(target), info); err != nil {
+					return fmt.Errorf("error archiving %s: %v", file, err)
+				}
+				return nil
+			}
+			if info, err = p.os.Stat(resolved); err != nil {
+				return fmt.Errorf("error following symlink %s: %v", file, err)
+			}
+			if info.IsDir() {
+				if visited[resolved] {
+					return fmt.Errorf("error following symlink %s: loop detected", file)
+				}
+				return p.archiveTree(aw, root, resolved, entryName, visited)
+			}
+			return p.archiveFile(aw, resolved, entryName, info)
+		}
+
+		if info.IsDir() {
+			if err := aw.writeDir(entryName, info); err != nil {
+				return fmt.Errorf("error archiving %s: %v", file, err)
+			}
+			return nil
+		}
+		return p.archiveFile(aw, file, entryName, info)
+	})
+}
+
+// linkReader is implemented by the filesystems able to read symlinks, the
+// way afero.LinkReader does in later afero releases
+type linkReader interface {
+	ReadlinkIfPossible(name string) (string, error)
+}
+
+// readlink returns the target of a symlink through fs, which has to support
+// symlinks
+func readlink(fs afero.Fs, name string) (string, error) {
+	switch fs := fs.(type) {
+	case linkReader:
+		return fs.ReadlinkIfPossible(name)
+	case *afero.OsFs:
+		return os.Readlink(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("symlinks are not supported by %s", fs.Name())}
+}
+
+// maxLinkHops bounds the chains of symlinks resolveLink follows
+const maxLinkHops = 40
+
+// resolveLink returns the path a symlink points to through fs, following
+// the chains of symlinks
+func resolveLink(fs afero.Fs, name string) (string, error) {
+	for i := 0; i < maxLinkHops; i++ {
+		target, err := readlink(fs, name)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+		info, err := lstat(fs, name)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return name, nil
+		}
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("too many levels of symbolic links")}
+}
+
+// lstat stats name through fs without following a symlink, when fs supports
+// them
+func lstat(fs afero.Fs, name string) (os.FileInfo, error) {
+	if lfs, ok := fs.(afero.Lstater); ok {
+		info, _, err := lfs.LstatIfPossible(name)
+		return info, err
+	}
+	return fs.Stat(name)
+}
+
+func (p *provisioner) archiveFile(aw archiveWriter, file, name string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := p.os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", file, err)
+	}
+	defer f.Close()
+	if err := aw.writeFile(name, info, f); err != nil {
+		return fmt.Errorf("error archiving %s: %v", file, err)
+	}
+	return nil
+}
+
+func isWithin(root, file string) bool {
+	rel, err := filepath.Rel(root, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// createArchive builds the archive of the entries in a local temporary file,
+// returning it ready to be read along with its sha256 checksum
+func (p *provisioner) createArchive(entries []archiveEntry, sync *bundleSync) (afero.File, string, error) {
+	f, err := afero.TempFile(p.os, "", "chefsolo-")
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating archive: %v", err)
+	}
+
+	h := sha256.New()
+	if err := p.buildArchive(io.MultiWriter(f, h), entries, sync); err != nil {
+		p.removeArchive(f)
+		return nil, "", fmt.Errorf("error creating archive: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		p.removeArchive(f)
+		return nil, "", fmt.Errorf("error reading archive: %v", err)
+	}
+	return f, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p *provisioner) removeArchive(f afero.File) {
+	f.Close()
+	p.os.Remove(f.Name())
+}
+
+// uploadArchive uploads the bundle as a single archive to uploadDir and
+// extracts it within confDir once its checksum is verified. In sync mode only
+// the changes are uploaded, and the files gone from the bundle are removed.
+func (p *provisioner) uploadArchive(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	confDir, uploadDir string) error {
+	entries := p.archiveEntries(o)
+	var sync *bundleSync
+	if p.UploadMode == uploadModeSync {
+		manifestPath := path.Join(confDir, p.BaseOutputDir, manifestFile)
+		readCmd := fmt.Sprintf("cat %s 2>/dev/null || true", shellQuote(manifestPath))
+		var err error
+		if sync, err = p.prepareSync(ctx, o, comm, readCmd, entries); err != nil {
+			return err
+		}
+	}
+
+	f, sum, err := p.createArchive(entries, sync)
+	if err != nil {
+		return err
+	}
+	defer p.removeArchive(f)
+
+	archive := p.BaseOutputDir + p.archiveExtension()
+	tarFlags := "-xzf"
+	if p.ArchiveCompression == compressionXz {
+		tarFlags = "-xJf"
+	}
+	remoteArchive := path.Join(uploadDir, archive)
+
+	o.Output(fmt.Sprintf("Uploading %s (sha256 %s)", remoteArchive, sum))
+	if err := comm.Upload(remoteArchive, f); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", archive, err)
+	}
+
+	cmd := fmt.Sprintf("cd %s && echo %s | sha256sum -c - && tar --no-same-owner %s %s && rm -f %s",
+		shellQuote(confDir), shellQuote(sum+"  "+remoteArchive), tarFlags, shellQuote(remoteArchive),
+		shellQuote(remoteArchive))
+	if err := p.runRemote(ctx, o, comm, cmd); err != nil {
+		return fmt.Errorf("extracting %s failed: %v", archive, err)
+	}
+
+	if sync != nil && len(sync.deleted) > 0 {
+		cmd := fmt.Sprintf("cd %s && rm -f -- %s",
+			shellQuote(path.Join(confDir, p.BaseOutputDir)), shellJoin(sync.deleted...))
+		if err := p.runRemote(ctx, o, comm, cmd); err != nil {
+			return fmt.Errorf("removing stale files failed: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package chefsolo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+	"github.com/ulikunitz/xz"
+)
+
+// uploadCommunicator records the uploaded content instead of comparing it
+type uploadCommunicator struct {
+	communicator.MockCommunicator
+	uploaded map[string][]byte
+}
+
+func (c *uploadCommunicator) Upload(path string, input io.Reader) error {
+	b, err := ioutil.ReadAll(input)
+	c.uploaded[path] = b
+	return err
+}
+
+func (c *uploadCommunicator) UploadScript(path string, input io.Reader) error {
+	return c.Upload(path, input)
+}
+
+func testArchiveTree(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "tf-test")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	output := filepath.Join(dir, "output")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{
+		filepath.Join(output, "cookbooks", "app", "recipes"),
+		filepath.Join(outside, "shared"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(output, "cookbooks", "app", "recipes", "default.rb"): "package 'app'",
+		filepath.Join(outside, "shared", "attributes.rb"):                  "default['app'] = true",
+		filepath.Join(outside, "README.md"):                                "readme",
+	}
+	for f, content := range files {
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(output, "cookbooks", "app", "recipes", "alias.rb"): "default.rb",
+		filepath.Join(output, "cookbooks", "shared"):                     filepath.Join(outside, "shared"),
+		filepath.Join(output, "README.md"):                               "../outside/README.md",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	return dir, output
+}
+
+func TestResourceProvider_buildArchive(t *testing.T) {
+	cases := map[string]struct {
+		Compression string
+		Reader      func(io.Reader) (io.Reader, error)
+	}{
+		"gzip": {
+			Compression: compressionGzip,
+			Reader: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		"xz": {
+			Compression: compressionXz,
+			Reader: func(r io.Reader) (io.Reader, error) {
+				return xz.NewReader(r)
+			},
+		},
+	}
+
+	for k, tc := range cases {
+		dir, output := testArchiveTree(t)
+		defer os.RemoveAll(dir)
+
+		p := &provisioner{os: afero.NewOsFs(), ArchiveCompression: tc.Compression}
+
+		var buf bytes.Buffer
+		if err := p.buildArchive(&buf, []archiveEntry{{output, "output"}}, nil); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		r, err := tc.Reader(&buf)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		entries := make(map[string]*tar.Header)
+		contents := make(map[string]string)
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Test %q failed: %v", k, err)
+			}
+			entries[h.Name] = h
+			b, _ := ioutil.ReadAll(tr)
+			contents[h.Name] = string(b)
+		}
+
+		if h, ok := entries["output/cookbooks/app/recipes/alias.rb"]; !ok || h.Typeflag != tar.TypeSymlink || h.Linkname != "default.rb" {
+			t.Fatalf("Test %q failed: the symlink within the bundle should be kept, got %+v", k, h)
+		}
+		for name, content := range map[string]string{
+			"output/cookbooks/app/recipes/default.rb": "package 'app'",
+			"output/cookbooks/shared/attributes.rb":   "default['app'] = true",
+			"output/README.md":                        "readme",
+		} {
+			if h, ok := entries[name]; !ok || h.Typeflag != tar.TypeReg || contents[name] != content {
+				t.Fatalf("Test %q failed: expected %s to be a regular file containing %q, got %+v", k, name, content, h)
+			}
+		}
+	}
+}
+
+// symlinkFs is an in memory filesystem reading symlinks from a fixed table
+type symlinkFs struct {
+	afero.Fs
+	links map[string]string
+}
+
+func (fs symlinkFs) ReadlinkIfPossible(name string) (string, error) {
+	if target, ok := fs.links[name]; ok {
+		return target, nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+}
+
+func TestReadlink(t *testing.T) {
+	cases := map[string]struct {
+		Fs     afero.Fs
+		Target string
+		Error  bool
+	}{
+		"Link reader": {
+			Fs:     symlinkFs{afero.NewMemMapFs(), map[string]string{"/output/alias.rb": "default.rb"}},
+			Target: "default.rb",
+		},
+		"Without symlinks": {
+			Fs:    afero.NewMemMapFs(),
+			Error: true,
+		},
+	}
+	for k, tc := range cases {
+		target, err := readlink(tc.Fs, "/output/alias.rb")
+		if (err != nil) != tc.Error || target != tc.Target {
+			t.Fatalf("Test %q failed: expected %q and error %t, got %q and %v", k, tc.Target, tc.Error, target, err)
+		}
+	}
+}
+
+func TestResourceProvider_uploadArchive(t *testing.T) {
+	cases := map[string]struct {
+		Config  map[string]interface{}
+		Archive string
+		Tar     string
+	}{
+		"gzip": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"upload_mode":      "archive",
+			},
+			Archive: "output.tar.gz",
+			Tar:     "-xzf",
+		},
+		"xz": {
+			Config: map[string]interface{}{
+				"instance_id":         `toto`,
+				"chef_module_path":    `/input`,
+				"output_dir":          `/output`,
+				"nodes":               []string{`{ "id":"toto"}`},
+				"target_node":         `{ "id":"toto"}`,
+				"upload_mode":         "archive",
+				"archive_compression": "xz",
+			},
+			Archive: "output.tar.xz",
+			Tar:     "-xJf",
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+	for k, tc := range cases {
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, tc.Config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		afero.WriteFile(fs, "/output/nodes/toto.json", []byte(`{ "id":"toto"}`), 0644)
+
+		var commands []string
+		c := &uploadCommunicator{uploaded: make(map[string][]byte)}
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			commands = append(commands, cmd.Command)
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		if err := p.uploadArchive(context.Background(), o, c, linuxConfDir, linuxConfDir); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		uploaded, ok := c.uploaded[linuxConfDir+"/"+tc.Archive]
+		if !ok {
+			t.Fatalf("Test %q failed: %s was not uploaded", k, tc.Archive)
+		}
+		sum := sha256.Sum256(uploaded)
+		remoteArchive := linuxConfDir + "/" + tc.Archive
+		expected := "cd /opt/chef/0 && echo '" + hex.EncodeToString(sum[:]) + "  " + remoteArchive + "' | sha256sum -c - && " +
+			"tar --no-same-owner " + tc.Tar + " " + remoteArchive + " && rm -f " + remoteArchive
+		if len(commands) != 1 || commands[0] != expected {
+			t.Fatalf("Test %q failed: expected %q, got %q", k, expected, strings.Join(commands, "\n"))
+		}
+	}
+}
+
+func TestResourceProvider_windowsUploadArchive(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"resources":        []interface{}{"/resources/roles"},
+	}
+
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	p.OSType = "windows"
+	p.DefaultConfDir = windowsConfDir
+	afero.WriteFile(fs, "/output/nodes/toto.json", []byte(`{ "id":"toto"}`), 0644)
+	afero.WriteFile(fs, "/resources/roles/base.json", []byte(`{ "name":"base"}`), 0644)
+
+	var commands []string
+	c := &uploadCommunicator{uploaded: make(map[string][]byte)}
+	c.RemoteScriptPath = "C:/Temp/terraform.cmd"
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		commands = append(commands, cmd.Command)
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+
+	if err := p.windowsUploadArchive(context.Background(), new(terraform.MockUIOutput), c); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	uploaded, ok := c.uploaded[windowsConfDir+"/output.zip"]
+	if !ok {
+		t.Fatalf("output.zip was not uploaded")
+	}
+	zr, err := zip.NewReader(bytes.NewReader(uploaded), int64(len(uploaded)))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	files := make(map[string]bool)
+	for _, f := range zr.File {
+		files[f.Name] = true
+	}
+	for _, name := range []string{"output/nodes/toto.json", "output/roles/base.json"} {
+		if !files[name] {
+			t.Fatalf("%s is missing from the archive, got %v", name, files)
+		}
+	}
+
+	sum := sha256.Sum256(uploaded)
+	script := string(c.uploaded["C:/Temp/ExpandBundle.ps1"])
+	if !strings.Contains(script, "$expected = '"+hex.EncodeToString(sum[:])+"'") {
+		t.Fatalf("the expand script does not check the archive checksum:\n%s", script)
+	}
+	expected := "powershell -NoProfile -ExecutionPolicy Bypass -File C:/Temp/ExpandBundle.ps1"
+	if len(commands) != 1 || commands[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(commands, "\n"))
+	}
+}
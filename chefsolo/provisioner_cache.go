@@ -0,0 +1,338 @@
+package chefsolo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+)
+
+const (
+	chefignoreFile        = "chefignore"
+	defaultBundleCacheDir = "~/.terraform.d/chefsolo-cache"
+	// bundleOutputToken stands for the output directory within the cache key,
+	// so every provisioner block bundling the same cookbooks shares the key
+	bundleOutputToken = "<output_dir>"
+)
+
+// bundleInputs returns the lock files describing the bundle, relative to the
+// chef module path
+func (p *provisioner) bundleInputs() []string {
+	if p.UsePolicyfile {
+		return []string{"Policyfile.rb", "Policyfile.lock.json"}
+	}
+	return []string{"Berksfile", "Berksfile.lock"}
+}
+
+// bundleKey hashes everything the bundle depends on: the bundle commands, the
+// Berksfile or Policyfile along with their lock, and the cookbook sources
+// minus the files listed in chefignore
+func (p *provisioner) bundleKey() (string, error) {
+	chefPath, err := homedir.Expand(p.ChefModulePath)
+	if err != nil {
+		return "", fmt.Errorf("error expanding the chef module path %s: %v", p.ChefModulePath, err)
+	}
+	root, err := filepath.Abs(chefPath)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %v", chefPath, err)
+	}
+
+	h := sha256.New()
+	for _, command := range p.getBundleCommand(bundleOutputToken) {
+		fmt.Fprintf(h, "command %s\x00", command)
+	}
+	for _, input := range p.bundleInputs() {
+		b, err := afero.ReadFile(p.os, filepath.Join(root, input))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintf(h, "missing %s\x00", input)
+		case err != nil:
+			return "", fmt.Errorf("error reading %s: %v", input, err)
+		default:
+			fmt.Fprintf(h, "input %s %d\x00", input, len(b))
+			h.Write(b)
+		}
+	}
+
+	ignores, err := p.readChefignore(root)
+	if err != nil {
+		return "", err
+	}
+	// The local directories written by the provisioner may live within the
+	// chef module path, they must not change the key
+	skipped := map[string]bool{}
+	for _, dir := range []string{p.outputRoot, p.OutputDir, p.LogDir, p.BundleCacheDir} {
+		if abs, err := filepath.Abs(dir); err == nil && dir != "" {
+			skipped[abs] = true
+		}
+	}
+
+	t := &treeHasher{p: p, h: h, ignores: ignores, skipped: skipped, linked: map[string]bool{}}
+	if err := t.hash(root, ""); err != nil {
+		return "", fmt.Errorf("error hashing the cookbook sources: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// treeHasher hashes the cookbook sources, following the symlinks so a change
+// within a linked cookbook changes the key
+type treeHasher struct {
+	p       *provisioner
+	h       hash.Hash
+	ignores chefignore
+	skipped map[string]bool
+	// linked holds the linked directories being hashed, against link loops
+	linked map[string]bool
+}
+
+// hash hashes the dir tree, naming its files after prefix
+func (t *treeHasher) hash(dir, prefix string) error {
+	return afero.Walk(t.p.os, dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if t.skipped[file] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || (rel == "." && prefix == "") {
+			return err
+		}
+		rel = path.Join(prefix, filepath.ToSlash(rel))
+		if t.ignores.ignored(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := resolveLink(t.p.os, file)
+			if err != nil {
+				return fmt.Errorf("error reading symlink %s: %v", file, err)
+			}
+			if info, err = t.p.os.Stat(target); err != nil {
+				return fmt.Errorf("error following symlink %s: %v", file, err)
+			}
+			if info.IsDir() {
+				if t.linked[target] {
+					return fmt.Errorf("symlink loop at %s", file)
+				}
+				t.linked[target] = true
+				defer delete(t.linked, target)
+				fmt.Fprintf(t.h, "symlink %s\x00", rel)
+				return t.hash(target, rel)
+			}
+			file = target
+		}
+
+		switch {
+		case info.IsDir():
+			if file != dir {
+				fmt.Fprintf(t.h, "dir %s\x00", rel)
+			}
+		case info.Mode().IsRegular():
+			f, err := t.p.os.Open(file)
+			if err != nil {
+				return fmt.Errorf("error opening %s: %v", file, err)
+			}
+			defer f.Close()
+			fmt.Fprintf(t.h, "file %s %o %d\x00", rel, info.Mode().Perm(), info.Size())
+			if _, err := io.Copy(t.h, f); err != nil {
+				return fmt.Errorf("error reading %s: %v", file, err)
+			}
+		}
+		return nil
+	})
+}
+
+// chefignore holds the patterns of a chefignore file
+type chefignore []*regexp.Regexp
+
+// readChefignore parses the chefignore file at the root of the chef module
+// path, if any
+func (p *provisioner) readChefignore(root string) (chefignore, error) {
+	f, err := p.os.Open(filepath.Join(root, chefignoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", chefignoreFile, err)
+	}
+	defer f.Close()
+
+	var ignores chefignore
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := globRegexp(line)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s pattern %q: %v", chefignoreFile, line, err)
+		}
+		ignores = append(ignores, re)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", chefignoreFile, err)
+	}
+	return ignores, nil
+}
+
+func (c chefignore) ignored(file string) bool {
+	for _, re := range c {
+		if re.MatchString(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexp translates a chefignore pattern into a regexp. Chef matches them
+// with fnmatch without FNM_PATHNAME, so wildcards also match slashes.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b bytes.Buffer
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// bundleChefCached fills the output directory from the bundle cache, running
+// the bundle commands only when nothing matches the current cookbooks
+func (p *provisioner) bundleChefCached(ctx context.Context, o terraform.UIOutput) error {
+	key, err := p.bundleKey()
+	if err != nil {
+		return err
+	}
+	cached := path.Join(p.BundleCacheDir, key)
+
+	if _, err := p.os.Stat(cached); err == nil {
+		o.Output("Reusing cached bundle " + key)
+		return p.copyTree(cached, p.OutputDir)
+	}
+
+	o.Output("No cached bundle for " + key + ", bundling cookbooks")
+	if err := p.os.MkdirAll(p.BundleCacheDir, 0755); err != nil {
+		return fmt.Errorf("error creating bundle cache directory %s: %v", p.BundleCacheDir, err)
+	}
+	// Bundle in a staging directory renamed once complete, so an interrupted
+	// bundle never gets reused and concurrent applies do not mix their files
+	staging, err := afero.TempDir(p.os, p.BundleCacheDir, ".staging-")
+	if err != nil {
+		return fmt.Errorf("error creating bundle staging directory: %v", err)
+	}
+	defer p.os.RemoveAll(staging)
+
+	if err := p.runBundleCommand(ctx, o, staging); err != nil {
+		return err
+	}
+	if err := p.os.Rename(staging, cached); err != nil {
+		// Another apply may have filled the cache in the meantime
+		if _, statErr := p.os.Stat(cached); statErr != nil {
+			return fmt.Errorf("error storing bundle in cache %s: %v", cached, err)
+		}
+	}
+	return p.copyTree(cached, p.OutputDir)
+}
+
+// copyTree copies the src tree into dst, following symlinks
+func (p *provisioner) copyTree(src, dst string) error {
+	return afero.Walk(p.os, src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = p.os.Stat(file); err != nil {
+				return fmt.Errorf("error following symlink %s: %v", file, err)
+			}
+			if info.IsDir() {
+				resolved, err := resolveLink(p.os, file)
+				if err != nil {
+					return fmt.Errorf("error following symlink %s: %v", file, err)
+				}
+				return p.copyTree(resolved, target)
+			}
+		}
+		if info.IsDir() {
+			if err := p.os.MkdirAll(target, info.Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("error creating directory %s: %v", target, err)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return p.copyFile(file, target, info.Mode().Perm())
+	})
+}
+
+func (p *provisioner) copyFile(src, dst string, perm os.FileMode) error {
+	in, err := p.os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := p.os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %s to %s: %v", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %v", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package chefsolo
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	cases := map[string]struct {
+		Pattern string
+		Match   []string
+		NoMatch []string
+	}{
+		"star crosses directories": {
+			Pattern: ".git/*",
+			Match:   []string{".git/HEAD", ".git/objects/ab/cdef"},
+			NoMatch: []string{".git", "cookbooks/.git"},
+		},
+		"suffix": {
+			Pattern: "*~",
+			Match:   []string{"README.md~", "recipes/default.rb~"},
+			NoMatch: []string{"README.md"},
+		},
+		"nested": {
+			Pattern: "*/.svn/*",
+			Match:   []string{"app/.svn/entries"},
+			NoMatch: []string{".svn/entries"},
+		},
+		"question mark and class": {
+			Pattern: "[#]*#",
+			Match:   []string{"#default.rb#"},
+			NoMatch: []string{"default.rb#"},
+		},
+		"negated class": {
+			Pattern: "*.[!r]b",
+			Match:   []string{"file.xb"},
+			NoMatch: []string{"file.rb"},
+		},
+		"regexp characters are literal": {
+			Pattern: "Berksfile.lock",
+			Match:   []string{"Berksfile.lock"},
+			NoMatch: []string{"BerksfileXlock"},
+		},
+	}
+
+	for k, tc := range cases {
+		re, err := globRegexp(tc.Pattern)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		for _, m := range tc.Match {
+			if !re.MatchString(m) {
+				t.Fatalf("Test %q failed: %q should match %q", k, tc.Pattern, m)
+			}
+		}
+		for _, m := range tc.NoMatch {
+			if re.MatchString(m) {
+				t.Fatalf("Test %q failed: %q should not match %q", k, tc.Pattern, m)
+			}
+		}
+	}
+}
+
+func TestResourceProvider_bundleKey(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/input/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+	}
+
+	cases := map[string]struct {
+		Change  func(fs afero.Fs, config map[string]interface{})
+		Changed bool
+	}{
+		"nothing changed": {
+			Change:  func(fs afero.Fs, config map[string]interface{}) {},
+			Changed: false,
+		},
+		"cookbook source changed": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				afero.WriteFile(fs, "/input/cookbooks/app/recipes/default.rb", []byte("package 'app2'"), 0644)
+			},
+			Changed: true,
+		},
+		"Berksfile.lock changed": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				afero.WriteFile(fs, "/input/Berksfile.lock", []byte("DEPENDENCIES\n  app (1.0.1)"), 0644)
+			},
+			Changed: true,
+		},
+		"chefignored file changed": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				afero.WriteFile(fs, "/input/.git/HEAD", []byte("ref: refs/heads/other"), 0644)
+				afero.WriteFile(fs, "/input/cookbooks/app/recipes/default.rb~", []byte("backup"), 0644)
+			},
+			Changed: false,
+		},
+		"output written": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				afero.WriteFile(fs, "/input/output/nodes/toto.json", []byte(`{ "id":"toto"}`), 0644)
+			},
+			Changed: false,
+		},
+		"output dir moved": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				fs.RemoveAll("/input/output")
+				config["output_dir"] = `/elsewhere`
+			},
+			Changed: false,
+		},
+		"policyfile used": {
+			Change: func(fs afero.Fs, config map[string]interface{}) {
+				config["use_policyfile"] = true
+			},
+			Changed: true,
+		},
+	}
+
+	for k, tc := range cases {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, "/input/Berksfile", []byte("cookbook 'app', path: 'cookbooks/app'"), 0644)
+		afero.WriteFile(fs, "/input/Berksfile.lock", []byte("DEPENDENCIES\n  app (1.0.0)"), 0644)
+		afero.WriteFile(fs, "/input/chefignore", []byte("# comment\n.git/*\n*~\n"), 0644)
+		afero.WriteFile(fs, "/input/.git/HEAD", []byte("ref: refs/heads/master"), 0644)
+		afero.WriteFile(fs, "/input/cookbooks/app/recipes/default.rb", []byte("package 'app'"), 0644)
+
+		before, err := testProvisioner(t, fs, config).bundleKey()
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		tcConfig := make(map[string]interface{})
+		for key, v := range config {
+			tcConfig[key] = v
+		}
+		tc.Change(fs, tcConfig)
+		after, err := testProvisioner(t, fs, tcConfig).bundleKey()
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		if (before != after) != tc.Changed {
+			t.Fatalf("Test %q failed: expected the key to change: %t, got %s then %s", k, tc.Changed, before, after)
+		}
+	}
+}
+
+func TestResourceProvider_bundleChefCached(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"bundle_cache":     true,
+		"bundle_cache_dir": `/cache`,
+	}
+
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/input/Berksfile", []byte("cookbook 'app'"), 0644)
+	p := testProvisioner(t, fs, config)
+
+	key, err := p.bundleKey()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cached := path.Join("/cache", key)
+	afero.WriteFile(fs, path.Join(cached, "cookbooks/app/recipes/default.rb"), []byte("package 'app'"), 0644)
+
+	// The bundle commands would fail here, so a cache hit must not run them
+	if err := p.bundleChef(context.Background(), new(terraform.MockUIOutput)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	b, err := afero.ReadFile(fs, "/output/cookbooks/app/recipes/default.rb")
+	if err != nil || string(b) != "package 'app'" {
+		t.Fatalf("expected the cached bundle to be copied into the output dir, got %q: %v", b, err)
+	}
+}
+
+// linkFs is an in memory filesystem with symlinks, each link being an empty
+// file of the underlying filesystem redirected to its target
+type linkFs struct {
+	afero.Fs
+	links map[string]string
+}
+
+func (fs linkFs) resolve(name string) string {
+	for i := 0; i < maxLinkHops; i++ {
+		target, ok := fs.links[name]
+		if !ok {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+	}
+	return name
+}
+
+func (fs linkFs) ReadlinkIfPossible(name string) (string, error) {
+	if target, ok := fs.links[name]; ok {
+		return target, nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+}
+
+func (fs linkFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	info, err := fs.Fs.Stat(name)
+	if _, ok := fs.links[name]; ok && err == nil {
+		return linkInfo{info}, true, nil
+	}
+	return info, true, err
+}
+
+func (fs linkFs) Stat(name string) (os.FileInfo, error) { return fs.Fs.Stat(fs.resolve(name)) }
+func (fs linkFs) Open(name string) (afero.File, error)  { return fs.Fs.Open(fs.resolve(name)) }
+
+type linkInfo struct{ os.FileInfo }
+
+func (linkInfo) Mode() os.FileMode { return os.ModeSymlink | 0777 }
+func (linkInfo) IsDir() bool       { return false }
+
+func TestResourceProvider_bundleKeySymlink(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+	}
+
+	mem := afero.NewMemMapFs()
+	afero.WriteFile(mem, "/input/Berksfile", []byte("cookbook 'app', path: 'cookbooks/app'"), 0644)
+	afero.WriteFile(mem, "/shared/app/recipes/default.rb", []byte("package 'app'"), 0644)
+	afero.WriteFile(mem, "/input/cookbooks/app", nil, 0644)
+	fs := linkFs{mem, map[string]string{"/input/cookbooks/app": "../../shared/app"}}
+	p := testProvisioner(t, fs, config)
+
+	before, err := p.bundleKey()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	afero.WriteFile(mem, "/shared/app/recipes/default.rb", []byte("package 'app2'"), 0644)
+	after, err := p.bundleKey()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if before == after {
+		t.Fatalf("expected the key to change with the content of the linked cookbook, got %s", after)
+	}
+
+	if err := p.copyTree("/input/cookbooks", "/copy"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b, err := afero.ReadFile(mem, "/copy/app/recipes/default.rb")
+	if err != nil || string(b) != "package 'app2'" {
+		t.Fatalf("expected the linked cookbook to be copied, got %q: %v", b, err)
+	}
+}
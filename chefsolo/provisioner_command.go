@@ -1,6 +1,7 @@
 package chefsolo
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/armon/circbuf"
@@ -12,8 +13,36 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
+const (
+	escalationNone         = "none"
+	escalationSudo         = "sudo"
+	escalationSudoPassword = "sudo_password"
+	escalationDoas         = "doas"
+	escalationSu           = "su"
+	// stdinGuard keeps the escalated command from reading what is left of
+	// the password input
+	stdinGuard = "exec < /dev/null; "
+)
+
+var escalations = []string{escalationNone, escalationSudo, escalationSudoPassword, escalationDoas, escalationSu}
+
+// needsPassword tells whether the escalation reads privilege_password
+func needsPassword(escalation string) bool {
+	return escalation == escalationSudoPassword || escalation == escalationSu
+}
+
+func isValidEscalation(escalation string) bool {
+	for _, e := range escalations {
+		if e == escalation {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *provisioner) runLocal(ctx context.Context, o terraform.UIOutput, command string) error {
 
 	if command == "" {
@@ -113,21 +142,39 @@ func (p *provisioner) runLocal(ctx context.Context, o terraform.UIOutput, comman
 }
 
 // runRemote is used to run already prepared commands
-func (p *provisioner) runRemote(o terraform.UIOutput, comm communicator.Communicator, command string) error {
-	// Unless prevented, prefix the command with sudo
-	if p.useSudo {
-		command = "sudo bash -c '" + command + "'"
-	}
+func (p *provisioner) runRemote(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	command, stdin := p.escalate(command)
+	return p.startRemote(ctx, o, comm, command, stdin)
+}
+
+// runRemoteAsUser runs a command as the connecting user, without escalating
+// privileges
+func (p *provisioner) runRemoteAsUser(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	return p.startRemote(ctx, o, comm, command, nil)
+}
 
+func (p *provisioner) startRemote(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string, stdin io.Reader) error {
 	outR, outW := io.Pipe()
 	errR, errW := io.Pipe()
-	go copyOutputRemote(o, outR)
-	go copyOutputRemote(o, errR)
-	defer outW.Close()
-	defer errW.Close()
+	outDoneCh := make(chan struct{})
+	errDoneCh := make(chan struct{})
+	go copyOutputRemote(o, outR, outDoneCh)
+	go copyOutputRemote(o, errR, errDoneCh)
+	// The last lines may still be copied when the command is done, they have
+	// to reach the output before returning
+	defer func() {
+		outW.Close()
+		errW.Close()
+		<-outDoneCh
+		<-errDoneCh
+	}()
 
 	cmd := &remote.Cmd{
 		Command: command,
+		Stdin:   stdin,
 		Stdout:  outW,
 		Stderr:  errW,
 	}
@@ -137,22 +184,102 @@ func (p *provisioner) runRemote(o terraform.UIOutput, comm communicator.Communic
 		return fmt.Errorf("error executing command %q: %v", cmd.Command, err)
 	}
 
-	if err := cmd.Wait(); err != nil {
+	if err := p.waitRemote(ctx, cmd); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *provisioner) runMultipleCommands(o terraform.UIOutput, comm communicator.Communicator, commands []string) error {
+// escalate wraps the command according to the privilege escalation strategy,
+// returning what to write on its standard input. With sudo_password and su
+// the password is the only input: it is read by sudo -S, or by su from the
+// terminal of the session, and the command itself reads /dev/null so the
+// password never reaches it.
+func (p *provisioner) escalate(command string) (string, io.Reader) {
+	userFlag := ""
+	if p.PrivilegeUser != "" {
+		userFlag = "-u " + shellQuote(p.PrivilegeUser) + " "
+	}
+
+	switch p.PrivilegeEscalation {
+	case escalationSudo:
+		return "sudo " + userFlag + "bash -c " + shellQuote(command), nil
+	case escalationSudoPassword:
+		// -k always asks for the password, so it is read even when sudo
+		// has cached credentials
+		return "sudo -k -S -p '' " + userFlag + "bash -c " + shellQuote(stdinGuard+command), p.passwordInput()
+	case escalationSu:
+		user := p.PrivilegeUser
+		if user == "" {
+			user = "root"
+		}
+		return "su -s /bin/bash " + shellQuote(user) + " -c " + shellQuote(stdinGuard+command), p.passwordInput()
+	case escalationDoas:
+		return "doas " + userFlag + "sh -c " + shellQuote(command), nil
+	}
+	return command, nil
+}
+
+// passwordInput returns the standard input giving the privilege password
+func (p *provisioner) passwordInput() io.Reader {
+	return strings.NewReader(p.privilegePassword + "\n")
+}
+
+// runRemoteOutput runs a prepared command and returns its standard output
+// instead of displaying it
+func (p *provisioner) runRemoteOutput(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) (string, error) {
+	command, stdin := p.escalate(command)
+	return p.captureRemote(ctx, o, comm, command, stdin)
+}
+
+// runRemoteAsUserOutput runs a command as the connecting user and returns its
+// standard output
+func (p *provisioner) runRemoteAsUserOutput(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) (string, error) {
+	return p.captureRemote(ctx, o, comm, command, nil)
+}
+
+func (p *provisioner) captureRemote(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string, stdin io.Reader) (string, error) {
+	errR, errW := io.Pipe()
+	errDoneCh := make(chan struct{})
+	go copyOutputRemote(o, errR, errDoneCh)
+	defer func() {
+		errW.Close()
+		<-errDoneCh
+	}()
+
+	var stdout bytes.Buffer
+	cmd := &remote.Cmd{
+		Command: command,
+		Stdin:   stdin,
+		Stdout:  &stdout,
+		Stderr:  errW,
+	}
+
+	if err := comm.Start(cmd); err != nil {
+		return "", fmt.Errorf("error executing command %q: %v", cmd.Command, err)
+	}
+
+	if err := p.waitRemote(ctx, cmd); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+func (p *provisioner) runMultipleCommands(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	commands []string) error {
 	for _, command := range commands {
-		if err := p.runRemote(o, comm, command); err != nil {
+		if err := p.runRemote(ctx, o, comm, command); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func copyOutputRemote(o terraform.UIOutput, r io.Reader) {
+func copyOutputRemote(o terraform.UIOutput, r io.Reader, doneCh chan<- struct{}) {
+	defer close(doneCh)
 	lr := linereader.New(r)
 	for line := range lr.Ch {
 		o.Output(line)
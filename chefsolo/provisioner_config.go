@@ -1,8 +1,10 @@
 package chefsolo
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/mitchellh/go-homedir"
@@ -12,37 +14,90 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]+m`)
+
 type provisioner struct {
-	Channel             string
-	ClientOptions       []string
-	Environment         string
-	UsePolicyfile       bool
-	HTTPProxy           string
-	HTTPSProxy          string
-	NamedRunList        string
-	NOProxy             []string
-	OSType              string
-	InstanceId          string
-	SkipInstall         bool
-	SSLVerifyMode       string
-	Version             string
-	DefaultConfDir      string
-	ChefModulePath      string
-	OutputDir           string
-	BaseOutputDir       string
-	Nodes               []interface{}
-	Resources           []interface{}
-	TargetNode          string
-	osUploadConfigFiles provisionFn
-	installChefClient   provisionFn
-	installService      installFn
-	os                  afero.Fs
-
-	runChefClient    provisionFn
-	useSudo          bool
-	installAsService bool
+	Channel              string
+	ClientOptions        []string
+	Environment          string
+	UsePolicyfile        bool
+	HTTPProxy            string
+	HTTPSProxy           string
+	NamedRunList         string
+	NOProxy              []string
+	OSType               string
+	InstanceId           string
+	SkipInstall          bool
+	InstallerSource      string
+	InstallerPackage     string
+	InstallerCacheDir    string
+	InstallerSHA256      string
+	InstallMethod        string
+	PackageRepository    string
+	PackageGPGKey        string
+	Distribution         string
+	ChefClientPath       string
+	ChefLicense          string
+	SSLVerifyMode        string
+	Version              string
+	VersionPolicy        string
+	DefaultConfDir       string
+	RemoteConfDir        string
+	BundleID             string
+	FileCachePath        string
+	FileBackupPath       string
+	RemoteTmpDir         string
+	RemoteOwner          string
+	RemoteGroup          string
+	ChefModulePath       string
+	OutputDir            string
+	BaseOutputDir        string
+	Nodes                []interface{}
+	Resources            []interface{}
+	SecretKey            string
+	LogToFile            bool
+	LogDir               string
+	PrivilegeEscalation  string
+	PrivilegeUser        string
+	UploadMode           string
+	ArchiveCompression   string
+	BundleCache          bool
+	BundleCacheDir       string
+	BundleWaitTimeout    time.Duration
+	RunMode              string
+	UploadTimeout        time.Duration
+	InstallTimeout       time.Duration
+	RunTimeout           time.Duration
+	GracePeriod          time.Duration
+	RemoteLockFile       string
+	LockTimeout          time.Duration
+	RebootHandling       string
+	RebootTimeout        time.Duration
+	MaxPasses            int
+	SuccessExitCodes     []int
+	WhyRun               bool
+	FailOnPendingChanges bool
+	TargetNode           string
+	osUploadConfigFiles  provisionFn
+	installChefClient    provisionFn
+	installService       installFn
+	os                   afero.Fs
+	logMutex             sync.Mutex
+
+	runChefClient     provisionFn
+	chefCmd           string
+	dist              distribution
+	outputRoot        string
+	useSudo           bool
+	privilegePassword string
+	detachedRun       string
+	installAsService  bool
+	installedChef     *version.Version
+	stagingDirs       []string
 }
 
 // Provisioner returns a Chef provisioner
@@ -85,6 +140,10 @@ func Provisioner() terraform.ResourceProvisioner {
 				Type:     schema.TypeBool,
 				Optional: true,
 			},
+			"log_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
 			"use_policyfile": {
 				Type:     schema.TypeBool,
 				Optional: true,
@@ -102,6 +161,112 @@ func Provisioner() terraform.ResourceProvisioner {
 				Elem:     &schema.Schema{Type: schema.TypeString},
 				Optional: true,
 			},
+			"upload_mode": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"archive_compression": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  compressionGzip,
+			},
+			"bundle_cache": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"bundle_cache_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  defaultBundleCacheDir,
+			},
+			"bundle_wait_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "10m",
+			},
+			"run_mode": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  runModeForeground,
+			},
+			"upload_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"install_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"run_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"grace_period": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "30s",
+			},
+			"remote_lock_file": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"lock_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "30m",
+			},
+			"reboot_handling": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  rebootHandlingNone,
+			},
+			"reboot_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "15m",
+			},
+			"max_passes": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  5,
+			},
+			"success_exit_codes": {
+				Type:     schema.TypeList,
+				Elem:     &schema.Schema{Type: schema.TypeInt},
+				Optional: true,
+			},
+			"remote_conf_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"bundle_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"file_cache_path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"file_backup_path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"remote_tmp_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "/tmp",
+			},
+			"remote_owner": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
+			"remote_group": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "root",
+			},
 			"resources": {
 				Type:     schema.TypeList,
 				Elem:     &schema.Schema{Type: schema.TypeString},
@@ -120,13 +285,58 @@ func Provisioner() terraform.ResourceProvisioner {
 				Optional: true,
 				Default:  false,
 			},
+			"installer_source": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  installerSourceRemote,
+			},
+			"installer_package": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"installer_cache_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  defaultInstallerCacheDir,
+			},
+			"installer_sha256": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"install_method": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  installMethodScript,
+			},
+			"package_repository": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"package_gpg_key": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"distribution": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  distributionChef,
+			},
+			"chef_client_path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"chef_license": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
 			"prevent_sudo": {
 				Type:     schema.TypeBool,
 				Optional: true,
 			},
 			"secret_key": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
 			},
 			"ssl_verify_mode": {
 				Type:     schema.TypeString,
@@ -136,15 +346,43 @@ func Provisioner() terraform.ResourceProvisioner {
 				Type:     schema.TypeBool,
 				Optional: true,
 			},
+			"privilege_escalation": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"privilege_user": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"privilege_password": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
 			"install_as_service": {
 				Type:     schema.TypeBool,
 				Optional: true,
 				Default:  false,
 			},
+			"why_run": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"fail_on_pending_changes": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 			"version": {
 				Type:     schema.TypeString,
 				Optional: true,
 			},
+			"version_policy": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  versionPolicyExact,
+			},
 			"instance_id": {
 				Type:     schema.TypeString,
 				Required: true,
@@ -175,38 +413,85 @@ func Provisioner() terraform.ResourceProvisioner {
 
 func configureProvisioner(d *schema.ResourceData, osType afero.Fs) (*provisioner, error) {
 	p := &provisioner{
-		Channel:          d.Get("channel").(string),
-		ClientOptions:    getStringList(d.Get("client_options")),
-		Environment:      d.Get("environment").(string),
-		UsePolicyfile:    d.Get("use_policyfile").(bool),
-		SkipInstall:      d.Get("skip_install").(bool),
-		HTTPProxy:        d.Get("http_proxy").(string),
-		HTTPSProxy:       d.Get("https_proxy").(string),
-		NOProxy:          getStringList(d.Get("no_proxy")),
-		NamedRunList:     d.Get("named_run_list").(string),
-		OSType:           d.Get("os_type").(string),
-		SSLVerifyMode:    d.Get("ssl_verify_mode").(string),
-		Version:          d.Get("version").(string),
-		InstanceId:       d.Get("instance_id").(string),
-		useSudo:          d.Get("use_sudo").(bool),
-		installAsService: d.Get("install_as_service").(bool),
-		Nodes:            d.Get("nodes").([]interface{}),
-		Resources:        d.Get("resources").([]interface{}),
-		TargetNode:       d.Get("target_node").(string),
-		OutputDir:        d.Get("output_dir").(string),
-		ChefModulePath:   d.Get("chef_module_path").(string),
-		os:               afero.NewOsFs(),
+		Channel:              d.Get("channel").(string),
+		ClientOptions:        getStringList(d.Get("client_options")),
+		Environment:          d.Get("environment").(string),
+		UsePolicyfile:        d.Get("use_policyfile").(bool),
+		SkipInstall:          d.Get("skip_install").(bool),
+		InstallerSource:      d.Get("installer_source").(string),
+		InstallerPackage:     d.Get("installer_package").(string),
+		InstallerCacheDir:    d.Get("installer_cache_dir").(string),
+		InstallerSHA256:      strings.ToLower(d.Get("installer_sha256").(string)),
+		InstallMethod:        d.Get("install_method").(string),
+		PackageRepository:    d.Get("package_repository").(string),
+		PackageGPGKey:        d.Get("package_gpg_key").(string),
+		Distribution:         d.Get("distribution").(string),
+		ChefClientPath:       d.Get("chef_client_path").(string),
+		ChefLicense:          d.Get("chef_license").(string),
+		HTTPProxy:            d.Get("http_proxy").(string),
+		HTTPSProxy:           d.Get("https_proxy").(string),
+		NOProxy:              getStringList(d.Get("no_proxy")),
+		NamedRunList:         d.Get("named_run_list").(string),
+		OSType:               d.Get("os_type").(string),
+		SSLVerifyMode:        d.Get("ssl_verify_mode").(string),
+		Version:              d.Get("version").(string),
+		VersionPolicy:        d.Get("version_policy").(string),
+		InstanceId:           d.Get("instance_id").(string),
+		useSudo:              d.Get("use_sudo").(bool),
+		installAsService:     d.Get("install_as_service").(bool),
+		WhyRun:               d.Get("why_run").(bool),
+		FailOnPendingChanges: d.Get("fail_on_pending_changes").(bool),
+		PrivilegeUser:        d.Get("privilege_user").(string),
+		UploadMode:           d.Get("upload_mode").(string),
+		ArchiveCompression:   d.Get("archive_compression").(string),
+		BundleCache:          d.Get("bundle_cache").(bool),
+		BundleCacheDir:       d.Get("bundle_cache_dir").(string),
+		RemoteConfDir:        strings.TrimSuffix(d.Get("remote_conf_dir").(string), "/"),
+		BundleID:             d.Get("bundle_id").(string),
+		FileCachePath:        d.Get("file_cache_path").(string),
+		FileBackupPath:       d.Get("file_backup_path").(string),
+		RemoteTmpDir:         strings.TrimSuffix(d.Get("remote_tmp_dir").(string), "/"),
+		RemoteOwner:          d.Get("remote_owner").(string),
+		RemoteGroup:          d.Get("remote_group").(string),
+		Nodes:                d.Get("nodes").([]interface{}),
+		Resources:            d.Get("resources").([]interface{}),
+		SecretKey:            d.Get("secret_key").(string),
+		LogToFile:            d.Get("log_to_file").(bool),
+		LogDir:               d.Get("log_dir").(string),
+		TargetNode:           d.Get("target_node").(string),
+		OutputDir:            d.Get("output_dir").(string),
+		ChefModulePath:       d.Get("chef_module_path").(string),
+		os:                   afero.NewOsFs(),
 	}
 
 	if osType != nil {
 		p.os = osType
 	}
 
+	// prevent_sudo always wins, otherwise use_sudo is a shortcut for sudo
+	p.PrivilegeEscalation = d.Get("privilege_escalation").(string)
+	if p.PrivilegeEscalation == "" {
+		p.PrivilegeEscalation = escalationNone
+		if p.useSudo {
+			p.PrivilegeEscalation = escalationSudo
+		}
+	}
+	if d.Get("prevent_sudo").(bool) {
+		p.PrivilegeEscalation = escalationNone
+	}
+	if !isValidEscalation(p.PrivilegeEscalation) {
+		return nil, fmt.Errorf("unsupported privilege_escalation: %s", p.PrivilegeEscalation)
+	}
+	p.useSudo = p.PrivilegeEscalation != escalationNone
+	p.privilegePassword = d.Get("privilege_password").(string)
+	if needsPassword(p.PrivilegeEscalation) && p.privilegePassword == "" {
+		return nil, fmt.Errorf("privilege_escalation %s requires privilege_password", p.PrivilegeEscalation)
+	}
+
 	if nodes, ok := d.GetOk("nodes"); ok {
 		for _, node := range nodes.([]interface{}) {
-			tmp := make(map[string]interface{})
-			if err := json.Unmarshal([]byte(node.(string)), &tmp); err != nil {
-				return nil, fmt.Errorf("error unable to render json %s: %v", node, err)
+			if _, err := nodeID(node.(string)); err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -223,16 +508,73 @@ func configureProvisioner(d *schema.ResourceData, osType afero.Fs) (*provisioner
 		return nil, fmt.Errorf("error expanding the chef module path %s: %v", chefPath, err)
 	}
 
+	// The output directory is shared by every instance, each apply getting
+	// its own workspace within it once joinWorkspace is called
 	outputDir, err := homedir.Expand(p.OutputDir)
-	if _, err := p.os.Stat(outputDir); err == nil {
-		p.os.RemoveAll(outputDir)
-	}
 	if err := p.os.MkdirAll(outputDir, 0766); err != nil {
 		return nil, fmt.Errorf("error creating output directory %s: %v", outputDir, err)
 	}
 	p.OutputDir = outputDir
+	p.outputRoot = outputDir
 	p.BaseOutputDir = path.Base(p.OutputDir)
 
+	if p.BundleID == "" {
+		p.BundleID = defaultBundleID(p.InstanceId, d.Get("output_dir").(string))
+	}
+	if !isValidBundleID(p.BundleID) {
+		return nil, fmt.Errorf("invalid bundle_id %q", p.BundleID)
+	}
+
+	if p.LogDir == "" {
+		p.LogDir = path.Join(p.OutputDir, logfileDir)
+	}
+	if p.LogDir, err = homedir.Expand(p.LogDir); err != nil {
+		return nil, fmt.Errorf("error expanding the log directory %s: %v", p.LogDir, err)
+	}
+
+	if p.BundleWaitTimeout, err = time.ParseDuration(d.Get("bundle_wait_timeout").(string)); err != nil {
+		return nil, fmt.Errorf("error parsing bundle_wait_timeout: %v", err)
+	}
+
+	p.RunMode = d.Get("run_mode").(string)
+	for key, timeout := range map[string]*time.Duration{
+		"upload_timeout":  &p.UploadTimeout,
+		"install_timeout": &p.InstallTimeout,
+		"run_timeout":     &p.RunTimeout,
+		"grace_period":    &p.GracePeriod,
+	} {
+		if *timeout, err = parseTimeout(d.Get(key).(string)); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", key, err)
+		}
+	}
+	p.RemoteLockFile = d.Get("remote_lock_file").(string)
+	if p.LockTimeout, err = time.ParseDuration(d.Get("lock_timeout").(string)); err != nil {
+		return nil, fmt.Errorf("error parsing lock_timeout: %v", err)
+	}
+	p.RebootHandling = d.Get("reboot_handling").(string)
+	p.MaxPasses = d.Get("max_passes").(int)
+	if p.RebootTimeout, err = time.ParseDuration(d.Get("reboot_timeout").(string)); err != nil {
+		return nil, fmt.Errorf("error parsing reboot_timeout: %v", err)
+	}
+	for _, code := range d.Get("success_exit_codes").([]interface{}) {
+		p.SuccessExitCodes = append(p.SuccessExitCodes, code.(int))
+	}
+
+	if p.BundleCacheDir, err = homedir.Expand(p.BundleCacheDir); err != nil {
+		return nil, fmt.Errorf("error expanding the bundle cache directory %s: %v", p.BundleCacheDir, err)
+	}
+
+	if p.InstallerPackage, err = homedir.Expand(p.InstallerPackage); err != nil {
+		return nil, fmt.Errorf("error expanding the installer package %s: %v", p.InstallerPackage, err)
+	}
+	if p.InstallerCacheDir, err = homedir.Expand(p.InstallerCacheDir); err != nil {
+		return nil, fmt.Errorf("error expanding the installer cache directory %s: %v", p.InstallerCacheDir, err)
+	}
+
+	if err := p.configureDistribution(); err != nil {
+		return nil, err
+	}
+
 	// Make sure the SSLVerifyMode value is written as a symbol
 	if p.SSLVerifyMode != "" && !strings.HasPrefix(p.SSLVerifyMode, ":") {
 		p.SSLVerifyMode = fmt.Sprintf(":%s", p.SSLVerifyMode)
@@ -253,33 +595,317 @@ func (p *provisioner) configurePerOS(s *terraform.InstanceState) error {
 		}
 	}
 	// Set some values based on the targeted OS
+	var confDir string
 	switch p.OSType {
 	case "linux":
 		p.osUploadConfigFiles = p.linuxUploadConfigFiles
 		p.installChefClient = p.linuxInstallChefClient
 		p.installService = p.linuxInstallChefAsAService
-		p.DefaultConfDir = linuxConfDir
-		p.runChefClient = p.runChefClientFunc(linuxChefCmd, linuxConfDir)
+		confDir = p.dist.LinuxConfDir
+		if p.UploadMode == "" {
+			p.UploadMode = uploadModeDirectory
+		}
 	case "windows":
 		p.osUploadConfigFiles = p.windowsUploadConfigFiles
 		p.installChefClient = p.windowsInstallChefClient
 		p.installService = p.windowsInstallChefAsAService
-		p.DefaultConfDir = windowsConfDir
-		p.runChefClient = p.runChefClientFunc(windowsChefCmd, windowsConfDir)
+		confDir = p.dist.WindowsConfDir
 		p.useSudo = false
+		p.PrivilegeEscalation = escalationNone
+		// Uploading file by file over WinRM is way too slow to be the default
+		if p.UploadMode == "" {
+			p.UploadMode = uploadModeArchive
+		}
 	default:
 		return fmt.Errorf("unsupported os type: %s", p.OSType)
 	}
+
+	if p.InstallMethod == installMethodPackage && p.OSType != "linux" {
+		return fmt.Errorf("install_method %s is only supported on linux", installMethodPackage)
+	}
+
+	// Install from a package uploaded from the Terraform host for the
+	// machines without access to the internet
+	if p.InstallerSource == installerSourceLocal {
+		if err := p.checkPackageExtension(); err != nil {
+			return err
+		}
+		p.installChefClient = p.linuxInstallChefPackage
+		if p.OSType == "windows" {
+			p.installChefClient = p.windowsInstallChefPackage
+		}
+	}
+
+	// Every bundle gets its own directory, client.rb and caches so several
+	// provisioners can share a machine
+	if p.RemoteConfDir == "" {
+		p.RemoteConfDir = confDir
+	}
+	p.DefaultConfDir = path.Join(p.RemoteConfDir, p.BundleID)
+	if p.FileCachePath == "" {
+		p.FileCachePath = path.Join(p.DefaultConfDir, "cache")
+	}
+	if p.FileBackupPath == "" {
+		p.FileBackupPath = path.Join(p.DefaultConfDir, "backup")
+	}
+	p.chefCmd = p.clientCmd()
+	p.runChefClient = p.runChefClientFunc(p.chefCmd, p.DefaultConfDir)
 	return nil
 }
-func validateFn(_ *terraform.ResourceConfig) (ws []string, es []error) {
+func validateFn(c *terraform.ResourceConfig) (ws []string, es []error) {
+	if nodes, ok := c.Get("nodes"); ok && !c.IsComputed("nodes") {
+		ids := make(map[string]int)
+		for i, node := range getStringList(nodes) {
+			if c.IsComputed(fmt.Sprintf("nodes.%d", i)) {
+				continue
+			}
+			id, err := nodeID(node)
+			if err != nil {
+				es = append(es, fmt.Errorf("nodes.%d: %v", i, err))
+				continue
+			}
+			if j, ok := ids[id]; ok {
+				es = append(es, fmt.Errorf("nodes.%d: duplicate node id %q, already used by nodes.%d", i, id, j))
+				continue
+			}
+			ids[id] = i
+		}
+	}
+
+	if targetNode, ok := c.Get("target_node"); ok && !c.IsComputed("target_node") {
+		tmp := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(targetNode.(string)), &tmp); err != nil {
+			es = append(es, fmt.Errorf("target_node: error unable to render json: %v", err))
+		} else if id, ok := tmp["id"]; ok {
+			instanceID, known := c.Get("instance_id")
+			switch id := id.(type) {
+			case string:
+				if known && !c.IsComputed("instance_id") && id != instanceID.(string) {
+					es = append(es, fmt.Errorf("target_node: id %q does not match instance_id %q", id, instanceID))
+				}
+			default:
+				es = append(es, fmt.Errorf("target_node: id must be a string, got %T", id))
+			}
+		}
+	}
+
+	if namedRunList, ok := c.Get("named_run_list"); ok && !c.IsComputed("named_run_list") && namedRunList.(string) != "" {
+		if usePolicyfile, known := getConfigBool(c, "use_policyfile"); known && !usePolicyfile {
+			es = append(es, fmt.Errorf("named_run_list can only be used together with use_policyfile"))
+		}
+	}
+
+	escalation, escalationKnown := "", !c.IsComputed("privilege_escalation")
+	if v, ok := c.Get("privilege_escalation"); ok && escalationKnown {
+		escalation = v.(string)
+		if !isValidEscalation(escalation) {
+			es = append(es, fmt.Errorf("unsupported privilege_escalation %q, must be one of: %s",
+				escalation, strings.Join(escalations, ", ")))
+		}
+		if needsPassword(escalation) && !c.IsSet("privilege_password") {
+			es = append(es, fmt.Errorf("privilege_escalation %s requires privilege_password", escalation))
+		}
+	}
+
+	if v, ok := c.Get("upload_mode"); ok && !c.IsComputed("upload_mode") {
+		if mode := v.(string); mode != uploadModeDirectory && mode != uploadModeArchive && mode != uploadModeSync {
+			es = append(es, fmt.Errorf("unsupported upload_mode %q, must be one of: %s, %s, %s",
+				mode, uploadModeDirectory, uploadModeArchive, uploadModeSync))
+		}
+	}
+
+	if v, ok := c.Get("archive_compression"); ok && !c.IsComputed("archive_compression") {
+		if compression := v.(string); compression != compressionGzip && compression != compressionXz {
+			es = append(es, fmt.Errorf("unsupported archive_compression %q, must be one of: %s, %s",
+				compression, compressionGzip, compressionXz))
+		}
+	}
+
+	if v, ok := c.Get("bundle_id"); ok && !c.IsComputed("bundle_id") && !isValidBundleID(v.(string)) {
+		es = append(es, fmt.Errorf("invalid bundle_id %q, it may only contain letters, digits, '.', '_' and '-'", v))
+	}
+
+	if v, ok := c.Get("bundle_wait_timeout"); ok && !c.IsComputed("bundle_wait_timeout") {
+		if _, err := time.ParseDuration(v.(string)); err != nil {
+			es = append(es, fmt.Errorf("bundle_wait_timeout: %v", err))
+		}
+	}
+
+	if v, ok := c.Get("run_mode"); ok && !c.IsComputed("run_mode") {
+		if mode := v.(string); mode != runModeForeground && mode != runModeDetached {
+			es = append(es, fmt.Errorf("unsupported run_mode %q, must be one of: %s, %s",
+				mode, runModeForeground, runModeDetached))
+		}
+	}
+
+	for _, key := range []string{"upload_timeout", "install_timeout", "run_timeout", "grace_period"} {
+		if v, ok := c.Get(key); ok && !c.IsComputed(key) {
+			if _, err := parseTimeout(v.(string)); err != nil {
+				es = append(es, fmt.Errorf("%s: %v", key, err))
+			}
+		}
+	}
+
+	if v, ok := c.Get("reboot_handling"); ok && !c.IsComputed("reboot_handling") && !isValidRebootHandling(v.(string)) {
+		es = append(es, fmt.Errorf("unsupported reboot_handling %q, must be one of: %s",
+			v, strings.Join(rebootHandlings, ", ")))
+	}
+
+	if v, ok := c.Get("lock_timeout"); ok && !c.IsComputed("lock_timeout") {
+		if _, err := time.ParseDuration(v.(string)); err != nil {
+			es = append(es, fmt.Errorf("lock_timeout: %v", err))
+		}
+	}
+
+	if v, ok := c.Get("reboot_timeout"); ok && !c.IsComputed("reboot_timeout") {
+		if _, err := time.ParseDuration(v.(string)); err != nil {
+			es = append(es, fmt.Errorf("reboot_timeout: %v", err))
+		}
+	}
+
+	if v, ok := c.Get("max_passes"); ok && !c.IsComputed("max_passes") {
+		if passes, ok := v.(int); ok && passes < 1 {
+			es = append(es, fmt.Errorf("max_passes must be at least 1, got %d", passes))
+		}
+	}
+
+	installerSource, installerSourceKnown := installerSourceRemote, !c.IsComputed("installer_source")
+	if v, ok := c.Get("installer_source"); ok && installerSourceKnown {
+		if installerSource = v.(string); installerSource != installerSourceRemote && installerSource != installerSourceLocal {
+			es = append(es, fmt.Errorf("unsupported installer_source %q, must be one of: %s, %s",
+				installerSource, installerSourceRemote, installerSourceLocal))
+		}
+	}
+	if v, ok := c.Get("distribution"); ok && !c.IsComputed("distribution") {
+		if dist := v.(string); !isValidDistribution(dist) {
+			es = append(es, fmt.Errorf("unsupported distribution %q, must be one of: %s, %s, %s",
+				dist, distributionChef, distributionCinc, distributionCustom))
+		} else if dist == distributionCustom && !c.IsSet("chef_client_path") {
+			es = append(es, fmt.Errorf("distribution %s requires chef_client_path", distributionCustom))
+		}
+	}
+
+	if v, ok := c.Get("chef_license"); ok && !c.IsComputed("chef_license") {
+		if license := v.(string); !isValidChefLicense(license) {
+			es = append(es, fmt.Errorf("unsupported chef_license %q, must be one of: %s",
+				license, strings.Join(chefLicenses, ", ")))
+		}
+	} else if !ok && !c.IsComputed("distribution") && !c.IsComputed("version") {
+		dist, v := distributionChef, ""
+		if raw, ok := c.Get("distribution"); ok {
+			dist = raw.(string)
+		}
+		if raw, ok := c.Get("version"); ok {
+			v = raw.(string)
+		}
+		if distributions[dist].License && requiresLicense(v) {
+			which := "version " + v
+			if anyVersion(v) {
+				which = "the latest version"
+			}
+			ws = append(ws, fmt.Sprintf("%s requires the Chef license to be accepted, "+
+				"chef-client will fail on its license prompt unless chef_license is set", which))
+		}
+	}
+
+	if v, ok := c.Get("install_method"); ok && !c.IsComputed("install_method") {
+		switch method := v.(string); method {
+		case installMethodScript:
+		case installMethodPackage:
+			if installerSourceKnown && installerSource == installerSourceLocal {
+				es = append(es, fmt.Errorf("install_method %s can not be used with installer_source %s",
+					installMethodPackage, installerSourceLocal))
+			}
+		default:
+			es = append(es, fmt.Errorf("unsupported install_method %q, must be one of: %s, %s",
+				method, installMethodScript, installMethodPackage))
+		}
+	}
+	if v, ok := c.Get("installer_package"); ok && !c.IsComputed("installer_package") {
+		if installerSourceKnown && installerSource != installerSourceLocal {
+			es = append(es, fmt.Errorf("installer_package can only be used with installer_source %s", installerSourceLocal))
+		}
+		if !isValidPackageExtension(v.(string)) {
+			es = append(es, fmt.Errorf("installer_package %s must be a .rpm, .deb or .msi package", v))
+		}
+	}
+
+	if !c.IsComputed("version_policy") && !c.IsComputed("version") {
+		policy, v := versionPolicyExact, ""
+		if raw, ok := c.Get("version_policy"); ok {
+			policy = raw.(string)
+		}
+		if raw, ok := c.Get("version"); ok {
+			v = raw.(string)
+		}
+		if err := checkVersion(v, policy); err != nil {
+			es = append(es, err)
+		}
+	}
+
+	if v, ok := c.Get("installer_sha256"); ok && !c.IsComputed("installer_sha256") && !isValidSHA256(v.(string)) {
+		es = append(es, fmt.Errorf("installer_sha256 %q must be a hex encoded sha256", v))
+	}
+
+	whyRun, whyRunKnown := getConfigBool(c, "why_run")
+	if failOnPending, known := getConfigBool(c, "fail_on_pending_changes"); known && failOnPending && whyRunKnown && !whyRun {
+		ws = append(ws, "fail_on_pending_changes has no effect without why_run")
+	}
+
+	if installAsService, known := getConfigBool(c, "install_as_service"); known && installAsService {
+		// The service would converge the machine on the next boot
+		if whyRunKnown && whyRun {
+			es = append(es, fmt.Errorf("install_as_service can not be used together with why_run"))
+		}
+		useSudo, useSudoKnown := getConfigBool(c, "use_sudo")
+		preventSudo, preventSudoKnown := getConfigBool(c, "prevent_sudo")
+		switch {
+		case preventSudoKnown && preventSudo:
+			es = append(es, fmt.Errorf("install_as_service can not be used together with prevent_sudo"))
+		case escalationKnown && escalation == escalationNone:
+			es = append(es, fmt.Errorf("install_as_service can not be used with privilege_escalation %s", escalationNone))
+		case escalationKnown && escalation == "" && useSudoKnown && !useSudo:
+			es = append(es, fmt.Errorf("install_as_service requires use_sudo or privilege_escalation to be set"))
+		}
+	}
+
 	return ws, es
 }
 
+// phaseOutput tees everything sent to the UI into the instance logfile,
+// tagging each line with the provisioning phase it belongs to
+type phaseOutput struct {
+	terraform.UIOutput
+	p     *provisioner
+	phase string
+}
+
 // Output implementation of terraform.UIOutput interface
-func (p *provisioner) Output(output string) {
-	logFile := path.Join(logfileDir, p.InstanceId)
-	f, err := p.os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0666)
+func (o *phaseOutput) Output(output string) {
+	o.UIOutput.Output(output)
+	o.p.log(o.phase, output)
+}
+
+// output returns the UI output to use for a phase, logging it to file if requested
+func (p *provisioner) output(o terraform.UIOutput, phase string) terraform.UIOutput {
+	if !p.LogToFile {
+		return o
+	}
+	return &phaseOutput{UIOutput: o, p: p, phase: phase}
+}
+
+// log appends output to the instance logfile
+func (p *provisioner) log(phase string, output string) {
+	p.logMutex.Lock()
+	defer p.logMutex.Unlock()
+
+	if err := p.os.MkdirAll(p.LogDir, 0755); err != nil {
+		log.Printf("Error creating logfile directory %s: %v", p.LogDir, err)
+		return
+	}
+
+	logFile := path.Join(p.LogDir, p.InstanceId)
+	f, err := p.os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Printf("Error creating logfile %s: %v", logFile, err)
 		return
@@ -289,11 +915,17 @@ func (p *provisioner) Output(output string) {
 	// These steps are needed to remove any ANSI escape codes used to colorize
 	// the output and to make sure we have proper line endings before writing
 	// the string to the logfile.
-	re := regexp.MustCompile(`\x1b\[[0-9;]+m`)
-	output = re.ReplaceAllString(output, "")
+	output = ansiEscape.ReplaceAllString(output, "")
+	output = strings.Replace(output, "\r\n", "\n", -1)
 	output = strings.Replace(output, "\r", "\n", -1)
 
-	if _, err := f.WriteString(output); err != nil {
+	var buf bytes.Buffer
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		fmt.Fprintf(&buf, "%s [%s] %s\n", timestamp, phase, line)
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
 		log.Printf("Error writing output to logfile %s: %v", logFile, err)
 	}
 
@@ -1,8 +1,11 @@
 package chefsolo
 
 import (
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
 	"github.com/spf13/afero"
+	"strings"
 	"testing"
 )
 
@@ -38,6 +41,17 @@ func TestResourceProvider_DecodeConfig(t *testing.T) {
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
 		},
+		"Node without id": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "name":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"run_list":         []interface{}{"cookbook::recipe"},
+			},
+		},
 		"Module Path does not exist": {
 			Config: map[string]interface{}{
 				"instance_id":      `toto`,
@@ -64,3 +78,649 @@ func TestResourceProvider_DecodeConfig(t *testing.T) {
 	}
 
 }
+
+func TestResourceProvider_Validate(t *testing.T) {
+	cases := map[string]struct {
+		Config   map[string]interface{}
+		Errors   int
+		Warnings int
+	}{
+		"Valid": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`, `{ "id":"titi"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Errors:   0,
+			Warnings: 1,
+		},
+		"Node without id": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "name":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Node Non-valid": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`sdsd{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Duplicate node ids": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`, `{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Target node id mismatch": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"titi"}`,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Named run list without policyfile": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"named_run_list":   "tototo",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Service without sudo": {
+			Config: map[string]interface{}{
+				"instance_id":        `toto`,
+				"chef_module_path":   `/input`,
+				"output_dir":         `/output`,
+				"nodes":              []interface{}{`{ "id":"toto"}`},
+				"target_node":        `{ "id":"toto"}`,
+				"install_as_service": true,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Unsupported privilege escalation": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []interface{}{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "pkexec",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Su": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []interface{}{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "su",
+				"privilege_password":   "s3cr3t",
+			},
+			Errors:   0,
+			Warnings: 1,
+		},
+		"Su without password": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []interface{}{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "su",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Sudo password without password": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []interface{}{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "sudo_password",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Service with doas": {
+			Config: map[string]interface{}{
+				"instance_id":          `toto`,
+				"chef_module_path":     `/input`,
+				"output_dir":           `/output`,
+				"nodes":                []interface{}{`{ "id":"toto"}`},
+				"target_node":          `{ "id":"toto"}`,
+				"privilege_escalation": "doas",
+				"install_as_service":   true,
+			},
+			Errors:   0,
+			Warnings: 1,
+		},
+		"Service with prevent_sudo": {
+			Config: map[string]interface{}{
+				"instance_id":        `toto`,
+				"chef_module_path":   `/input`,
+				"output_dir":         `/output`,
+				"nodes":              []interface{}{`{ "id":"toto"}`},
+				"target_node":        `{ "id":"toto"}`,
+				"use_sudo":           true,
+				"prevent_sudo":       true,
+				"install_as_service": true,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid bundle id": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"bundle_id":        "../etc",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid bundle wait timeout": {
+			Config: map[string]interface{}{
+				"instance_id":         `toto`,
+				"chef_module_path":    `/input`,
+				"output_dir":          `/output`,
+				"nodes":               []interface{}{`{ "id":"toto"}`},
+				"target_node":         `{ "id":"toto"}`,
+				"bundle_wait_timeout": "ten minutes",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid version policy": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "14.10",
+				"version_policy":   "newest",
+			},
+			Errors: 1,
+		},
+		"Constraint with exact version policy": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "~> 14.10",
+			},
+			Errors: 1,
+		},
+		"Unsatisfiable constraint": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "> 14, < 13",
+				"version_policy":   "constraint",
+			},
+			Errors: 1,
+		},
+		"Constraint version policy without version": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version_policy":   "constraint",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid install method": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"install_method":   "brew",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Package install method with local installer": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"install_method":   "package",
+				"installer_source": "local",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid installer sha256": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"installer_sha256": "d41d8cd98f00b204e9800998ecf8427e",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid installer source": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"installer_source": "ftp",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Installer package without local source": {
+			Config: map[string]interface{}{
+				"instance_id":       `toto`,
+				"chef_module_path":  `/input`,
+				"output_dir":        `/output`,
+				"nodes":             []interface{}{`{ "id":"toto"}`},
+				"target_node":       `{ "id":"toto"}`,
+				"installer_package": "chef-15.0.300-1.el7.x86_64.rpm",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid installer package": {
+			Config: map[string]interface{}{
+				"instance_id":       `toto`,
+				"chef_module_path":  `/input`,
+				"output_dir":        `/output`,
+				"nodes":             []interface{}{`{ "id":"toto"}`},
+				"target_node":       `{ "id":"toto"}`,
+				"installer_source":  "local",
+				"installer_package": "chef.tar.gz",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid distribution": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"distribution":     "opscode",
+			},
+			Errors: 1,
+		},
+		"Custom distribution without path": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"distribution":     "custom",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid chef license": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"chef_license":     "yes",
+			},
+			Errors: 1,
+		},
+		"Chef 15 without license": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "15.0.300",
+			},
+			Warnings: 1,
+		},
+		"Chef 15 with license": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "~> 15.0",
+				"version_policy":   "constraint",
+				"chef_license":     "accept-no-persist",
+			},
+		},
+		"Cinc 15 without license": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"version":          "15.0.300",
+				"distribution":     "cinc",
+			},
+		},
+		"Invalid timeouts": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"upload_timeout":   "10",
+				"run_timeout":      "2h",
+				"grace_period":     "soon",
+				"lock_timeout":     "",
+			},
+			Errors:   3,
+			Warnings: 1,
+		},
+		"Why-run as a service": {
+			Config: map[string]interface{}{
+				"instance_id":        `toto`,
+				"chef_module_path":   `/input`,
+				"output_dir":         `/output`,
+				"nodes":              []interface{}{`{ "id":"toto"}`},
+				"target_node":        `{ "id":"toto"}`,
+				"use_sudo":           true,
+				"install_as_service": true,
+				"why_run":            true,
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Fail on pending changes without why-run": {
+			Config: map[string]interface{}{
+				"instance_id":             `toto`,
+				"chef_module_path":        `/input`,
+				"output_dir":              `/output`,
+				"nodes":                   []interface{}{`{ "id":"toto"}`},
+				"target_node":             `{ "id":"toto"}`,
+				"fail_on_pending_changes": true,
+			},
+			Warnings: 2,
+		},
+		"Invalid run mode": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"run_mode":         "background",
+			},
+			Errors:   1,
+			Warnings: 1,
+		},
+		"Invalid reboot handling": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"reboot_handling":  "ignore",
+				"reboot_timeout":   "15",
+				"max_passes":       0,
+			},
+			Errors:   3,
+			Warnings: 1,
+		},
+		"Unknown values": {
+			Config: map[string]interface{}{
+				"instance_id":      config.UnknownVariableValue,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []interface{}{config.UnknownVariableValue, `{ "id":"toto"}`},
+				"target_node":      `{ "id":"titi"}`,
+				"use_policyfile":   config.UnknownVariableValue,
+				"named_run_list":   "tototo",
+			},
+			Errors:   0,
+			Warnings: 1,
+		},
+	}
+
+	for k, tc := range cases {
+		ws, es := Provisioner().Validate(testConfig(t, tc.Config))
+		if len(es) != tc.Errors {
+			t.Fatalf("Test %q failed: expected %d errors, got %d: %v", k, tc.Errors, len(es), es)
+		}
+		if len(ws) != tc.Warnings {
+			t.Fatalf("Test %q failed: expected %d warnings, got %d: %v", k, tc.Warnings, len(ws), ws)
+		}
+	}
+}
+
+func TestResourceProvider_remoteLayout(t *testing.T) {
+	cases := map[string]struct {
+		Config     map[string]interface{}
+		Connection string
+		ConfDir    string
+		CachePath  string
+		BackupPath string
+	}{
+		"Linux default": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Connection: "ssh",
+			ConfDir:    "/opt/chef/0/" + defaultBundleID("toto", "/output"),
+			CachePath:  "/opt/chef/0/" + defaultBundleID("toto", "/output") + "/cache",
+			BackupPath: "/opt/chef/0/" + defaultBundleID("toto", "/output") + "/backup",
+		},
+		"Windows default": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			Connection: "winrm",
+			ConfDir:    "C:/chef/" + defaultBundleID("toto", "/output"),
+			CachePath:  "C:/chef/" + defaultBundleID("toto", "/output") + "/cache",
+			BackupPath: "C:/chef/" + defaultBundleID("toto", "/output") + "/backup",
+		},
+		"Custom": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"remote_conf_dir":  `/etc/chef/`,
+				"bundle_id":        `hardening`,
+				"file_cache_path":  `/var/cache/chef`,
+			},
+			Connection: "ssh",
+			ConfDir:    "/etc/chef/hardening",
+			CachePath:  "/var/cache/chef",
+			BackupPath: "/etc/chef/hardening/backup",
+		},
+	}
+
+	for k, tc := range cases {
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, tc.Config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		state := &terraform.InstanceState{
+			Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{"type": tc.Connection}},
+		}
+		if err := p.configurePerOS(state); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if p.DefaultConfDir != tc.ConfDir || p.FileCachePath != tc.CachePath || p.FileBackupPath != tc.BackupPath {
+			t.Fatalf("Test %q failed: expected %s, %s and %s, got %s, %s and %s", k,
+				tc.ConfDir, tc.CachePath, tc.BackupPath, p.DefaultConfDir, p.FileCachePath, p.FileBackupPath)
+		}
+	}
+}
+
+func TestDefaultBundleID(t *testing.T) {
+	first := defaultBundleID("toto", "app/output")
+	if !strings.HasPrefix(first, "output-") || !isValidBundleID(first) {
+		t.Fatalf("expected a valid id named after the output dir, got %q", first)
+	}
+	if first != defaultBundleID("toto", "./app/output/") {
+		t.Fatalf("the bundle id must be stable")
+	}
+	if first == defaultBundleID("toto", "base/output") {
+		t.Fatalf("two output dirs with the same name must not share the bundle id %q", first)
+	}
+	if first == defaultBundleID("titi", "app/output") {
+		t.Fatalf("two instances must not share the bundle id %q", first)
+	}
+	if id := defaultBundleID("toto", "/projects/my bundle"); !isValidBundleID(id) {
+		t.Fatalf("expected a valid id, got %q", id)
+	}
+}
+
+func testConfig(t *testing.T, c map[string]interface{}) *terraform.ResourceConfig {
+	r, err := config.NewRawConfig(c)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return terraform.NewResourceConfig(r)
+}
+
+// testProvisioner configures a provisioner with the fs filesystem
+func testProvisioner(t *testing.T, fs afero.Fs, config map[string]interface{}) *provisioner {
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return p
+}
+
+func TestResourceProvider_logToFile(t *testing.T) {
+	cases := map[string]struct {
+		Config  map[string]interface{}
+		LogFile string
+	}{
+		"Default log dir": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"log_to_file":      true,
+			},
+			LogFile: "/output/logfiles/toto",
+		},
+		"Custom log dir": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"log_to_file":      true,
+				"log_dir":          `/logs`,
+			},
+			LogFile: "/logs/toto",
+		},
+	}
+
+	for k, tc := range cases {
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, tc.Config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		o := new(terraform.MockUIOutput)
+		p.output(o, "chef").Output("\x1b[32mfirst line\x1b[0m\r\nsecond line")
+		p.output(o, "upload").Output("third line")
+
+		if o.OutputMessage != "third line" {
+			t.Fatalf("Test %q failed: expected the UI to get the output, got %q", k, o.OutputMessage)
+		}
+
+		content, err := afero.ReadFile(fs, tc.LogFile)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		expected := []string{"[chef] first line", "[chef] second line", "[upload] third line"}
+		if len(lines) != len(expected) {
+			t.Fatalf("Test %q failed: expected %d lines, got %q", k, len(expected), content)
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, " "+expected[i]) {
+				t.Fatalf("Test %q failed: expected line %q to end with %q", k, line, expected[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package chefsolo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	runModeForeground = "foreground"
+	runModeDetached   = "detached"
+	// The files of a detached run are named after the run, so a run of the
+	// same bundle waiting for the lock never touches them
+	detachedLog    = "chef-client-%s.log"
+	detachedStatus = "chef-client-%s.status"
+	detachedScript = "chef-client-%s.cmd"
+	// detachedLogRetention is the age in days after which the logs of the
+	// previous runs are removed
+	detachedLogRetention = 7
+	// detachedMaxFailures is the number of polls in a row which may fail,
+	// reconnecting after each of them, before giving up on the run
+	detachedMaxFailures = 5
+	// The exit status is written to a temporary file first so a poll never
+	// reads it half written
+	linuxDetachedCmd      = `sh -c %s > %s 2>&1; echo $? > %s.tmp && mv %s.tmp %s`
+	windowsDetachedScript = `@echo off
+(%s) > %s 2>&1
+echo %%ERRORLEVEL%%> %s.tmp
+move /y %s.tmp %s > nul
+`
+	linuxPruneLogsCmd   = `find %s -maxdepth 1 -name 'chef-client-*.log' -mtime +%d -exec rm -f {} + 2> /dev/null`
+	windowsPruneLogsCmd = `powershell -NoProfile -Command "Get-ChildItem -Path %s -Filter 'chef-client-*.log' | ` +
+		`Where-Object { $_.LastWriteTime -lt (Get-Date).AddDays(-%d) } | Remove-Item -Force"`
+	windowsReadLogCmd = `powershell -NoProfile -Command "if (Test-Path %[1]s) { ` +
+		`$f = [IO.File]::Open(%[1]s, 'Open', 'Read', 'ReadWrite'); [void]$f.Seek(%[2]d, 'Begin'); ` +
+		`$b = New-Object byte[] ($f.Length - $f.Position); [void]$f.Read($b, 0, $b.Length); $f.Close(); ` +
+		`[Console]::OpenStandardOutput().Write($b, 0, $b.Length) }"`
+)
+
+var detachedPollInterval = 5 * time.Second
+
+// newRunID names a detached run
+var newRunID = func() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// runChefCommand runs chef-client in the foreground session, or in the
+// background with run_mode detached
+func (p *provisioner) runChefCommand(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	if p.RunMode == runModeDetached {
+		return p.runDetached(ctx, o, comm, command)
+	}
+	return p.runRemote(ctx, o, comm, command)
+}
+
+// runDetached starts chef-client in the background, writing its output to a
+// log and its exit status to a status file on the machine, then follows them
+// over short lived sessions. A dropped connection is reestablished without
+// disturbing the run, and the exit status of chef-client is returned the same
+// way a foreground run would.
+func (p *provisioner) runDetached(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	p.detachedRun = newRunID()
+	logFile := p.detachedFile(detachedLog)
+	statusFile := p.detachedFile(detachedStatus)
+
+	if err := p.startDetached(ctx, o, comm, command, logFile, statusFile); err != nil {
+		return err
+	}
+	o.Output(fmt.Sprintf("chef-client is running in the background, following %s", logFile))
+
+	var offset int
+	var partial string
+	failures := 0
+	for {
+		// The status is read before the log, so once it is there the log
+		// holds the whole output of the run
+		status, done, err := p.detachedStatus(ctx, o, comm, statusFile)
+		var out string
+		if err == nil {
+			out, err = p.readDetachedLog(ctx, o, comm, logFile, offset)
+		}
+		if err != nil {
+			if failures++; failures > detachedMaxFailures {
+				return fmt.Errorf("error following chef-client, the run may still be going on: %v", err)
+			}
+			o.Output(fmt.Sprintf("Lost the connection while following chef-client, reconnecting: %v", err))
+			if err := p.reconnect(ctx, o, comm); err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+
+		offset += len(out)
+		lines := strings.Split(partial+out, "\n")
+		partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			o.Output(strings.TrimSuffix(line, "\r"))
+		}
+
+		if done {
+			if partial != "" {
+				o.Output(partial)
+			}
+			p.cleanupDetached(ctx, o, comm)
+			if status != 0 {
+				return &remote.ExitError{Command: command, ExitStatus: status}
+			}
+			return nil
+		}
+		select {
+		case <-time.After(detachedPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for %q: %v", command, ctx.Err())
+		}
+	}
+}
+
+// startDetached removes the logs of the old runs and starts chef-client with
+// setsid and nohup on linux, or as a scheduled task on windows
+func (p *provisioner) startDetached(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command, logFile, statusFile string) error {
+
+	if p.OSType == "windows" {
+		// The script is a batch file, in which percent signs are doubled
+		// instead of being escaped
+		script := p.detachedFile(detachedScript)
+		content := fmt.Sprintf(windowsDetachedScript, cmdToBatch(command), batchQuote(logFile),
+			batchQuote(statusFile), batchQuote(statusFile), batchQuote(statusFile))
+		if err := comm.Upload(script, strings.NewReader(content)); err != nil {
+			return fmt.Errorf("uploading %s failed: %v", path.Base(script), err)
+		}
+		task := cmdQuote(p.detachedTaskName())
+		return p.runMultipleCommands(ctx, o, comm, []string{
+			fmt.Sprintf(windowsPruneLogsCmd, powershellQuote(p.DefaultConfDir), detachedLogRetention),
+			fmt.Sprintf("schtasks /Create /F /TN %s /SC ONCE /ST 00:00 /RU SYSTEM /RL HIGHEST /TR %s", task, cmdQuote(script)),
+			fmt.Sprintf("schtasks /Run /TN %s", task),
+		})
+	}
+
+	// setsid takes the run out of the session, which ends right away and
+	// would otherwise send it SIGHUP before nohup ignores it
+	run := fmt.Sprintf(linuxDetachedCmd, shellQuote(command), shellQuote(logFile),
+		shellQuote(statusFile), shellQuote(statusFile), shellQuote(statusFile))
+	return p.runRemote(ctx, o, comm, fmt.Sprintf(
+		linuxPruneLogsCmd+"; setsid nohup sh -c %s > /dev/null 2>&1 < /dev/null &",
+		shellQuote(p.DefaultConfDir), detachedLogRetention, shellQuote(run)))
+}
+
+// detachedStatus returns the exit status of the background run, and whether
+// it is over
+func (p *provisioner) detachedStatus(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	statusFile string) (int, bool, error) {
+
+	cmd := fmt.Sprintf("cat %s 2> /dev/null || true", shellQuote(statusFile))
+	if p.OSType == "windows" {
+		cmd = fmt.Sprintf("cmd /c if exist %s type %s", cmdQuote(statusFile), cmdQuote(statusFile))
+	}
+	out, err := p.runRemoteOutput(ctx, o, comm, cmd)
+	if err != nil {
+		return 0, false, err
+	}
+	if out = strings.TrimSpace(out); out == "" {
+		return 0, false, nil
+	}
+	status, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, false, fmt.Errorf("unexpected chef-client exit status %q", out)
+	}
+	return status, true, nil
+}
+
+// readDetachedLog returns the output of the background run past offset bytes
+func (p *provisioner) readDetachedLog(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	logFile string, offset int) (string, error) {
+
+	cmd := fmt.Sprintf("tail -c +%d %s 2> /dev/null || true", offset+1, shellQuote(logFile))
+	if p.OSType == "windows" {
+		cmd = fmt.Sprintf(windowsReadLogCmd, powershellQuote(logFile), offset)
+	}
+	return p.runRemoteOutput(ctx, o, comm, cmd)
+}
+
+// cleanupDetached removes the status file of a finished run, along with the
+// scheduled task and script of a windows run. The log is kept for
+// troubleshooting until it is pruned by a later run.
+func (p *provisioner) cleanupDetached(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator) {
+	statusFile := p.detachedFile(detachedStatus)
+	if p.OSType != "windows" {
+		if err := p.runRemote(ctx, o, comm, shellJoin("rm", "-f", statusFile)); err != nil {
+			o.Output(fmt.Sprintf("Unable to remove %s: %v", statusFile, err))
+		}
+		return
+	}
+	script := p.detachedFile(detachedScript)
+	deleteTask := fmt.Sprintf("schtasks /Delete /F /TN %s", cmdQuote(p.detachedTaskName()))
+	if err := p.runRemote(ctx, o, comm, deleteTask); err != nil {
+		o.Output(fmt.Sprintf("Unable to delete the scheduled task %s: %v", p.detachedTaskName(), err))
+	}
+	deleteFiles := fmt.Sprintf("cmd /c del /f /q %s %s", cmdQuote(statusFile), cmdQuote(script))
+	if err := p.runRemote(ctx, o, comm, deleteFiles); err != nil {
+		o.Output(fmt.Sprintf("Unable to remove %s: %v", statusFile, err))
+	}
+}
+
+// detachedFile returns the path of a file of the current detached run
+func (p *provisioner) detachedFile(format string) string {
+	return path.Join(p.DefaultConfDir, fmt.Sprintf(format, p.detachedRun))
+}
+
+func (p *provisioner) detachedTaskName() string {
+	return "chefsolo-" + p.BundleID + "-" + p.detachedRun
+}
+
+// reconnect drops the current connection and connects again, retrying until
+// the connection timeout
+func (p *provisioner) reconnect(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator) error {
+	comm.Disconnect()
+	ctx, cancel := context.WithTimeout(ctx, comm.Timeout())
+	defer cancel()
+	if err := communicator.Retry(ctx, func() error { return comm.Connect(o) }); err != nil {
+		return fmt.Errorf("error reconnecting: %v", err)
+	}
+	return nil
+}
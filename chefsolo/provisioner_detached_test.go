@@ -0,0 +1,199 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_runDetached(t *testing.T) {
+	const (
+		logFile    = "/opt/chef/0/app/chef-client-run1.log"
+		statusFile = "/opt/chef/0/app/chef-client-run1.status"
+	)
+	start := "find /opt/chef/0/app -maxdepth 1 -name 'chef-client-*.log' -mtime +7 -exec rm -f {} + 2> /dev/null; " +
+		"setsid nohup sh -c 'sh -c '\\''chef-client -z'\\'' > " + logFile +
+		" 2>&1; echo $? > " + statusFile + ".tmp && mv " + statusFile + ".tmp " + statusFile +
+		"' > /dev/null 2>&1 < /dev/null &"
+
+	cases := map[string]struct {
+		// Log is the content of the log at each poll, and Status the content
+		// of the status file
+		Log        []string
+		Status     []string
+		Drops      map[int]bool
+		Exit       int
+		Error      bool
+		Reconnects int
+	}{
+		"Success": {
+			Log:    []string{"", "Starting Chef Client\nConverg", "Starting Chef Client\nConverging 2 resources\nChef Client finished"},
+			Status: []string{"", "", "0\n"},
+		},
+		"Failure": {
+			Log:    []string{"Starting Chef Client\n", "Starting Chef Client\nConverging 2 resources\nChef Client failed\n"},
+			Status: []string{"", "1\n"},
+			Exit:   1,
+			Error:  true,
+		},
+		"Reboot needed": {
+			Log:    []string{"Starting Chef Client\nConverging 2 resources\nChef Client finished\n"},
+			Status: []string{"37\n"},
+			Exit:   exitRebootNeeded,
+			Error:  true,
+		},
+		"Dropped connection": {
+			Log:        []string{"Starting Chef Client\n", "", "Starting Chef Client\nConverging 2 resources\nChef Client finished\n"},
+			Status:     []string{"", "", "0\n"},
+			Drops:      map[int]bool{1: true},
+			Reconnects: 1,
+		},
+		"Lost connection": {
+			Log:        []string{"Starting Chef Client\n", "", "", "", "", "", ""},
+			Status:     []string{"", "", "", "", "", "", ""},
+			Drops:      map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true, 6: true},
+			Error:      true,
+			Reconnects: 5,
+		},
+	}
+
+	defer func(d time.Duration) { detachedPollInterval = d }(detachedPollInterval)
+	detachedPollInterval = 0
+	defer func(f func() string) { newRunID = f }(newRunID)
+	newRunID = func() string { return "run1" }
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"bundle_id":        "app",
+			"run_mode":         "detached",
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		var lines []string
+		o := new(terraform.MockUIOutput)
+		o.OutputFn = func(line string) {
+			if !strings.HasPrefix(line, "Lost the connection") {
+				lines = append(lines, line)
+			}
+		}
+
+		started, cleaned, poll, reconnects := false, false, -1, 0
+		c := new(communicator.MockCommunicator)
+		c.DisconnectFunc = func() error {
+			reconnects++
+			return nil
+		}
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			switch {
+			case cmd.Command == start:
+				started = true
+			case cmd.Command == "rm -f "+statusFile:
+				cleaned = true
+			case cmd.Command == "cat "+statusFile+" 2> /dev/null || true":
+				poll++
+				if poll >= len(tc.Status) {
+					t.Fatalf("Test %q failed: unexpected poll %d", k, poll)
+				}
+				if tc.Drops[poll] {
+					return fmt.Errorf("connection reset by peer")
+				}
+				io.WriteString(cmd.Stdout, tc.Status[poll])
+			case strings.HasPrefix(cmd.Command, "tail -c +"):
+				var offset int
+				fmt.Sscanf(cmd.Command, "tail -c +%d", &offset)
+				io.WriteString(cmd.Stdout, tc.Log[poll][offset-1:])
+			default:
+				t.Fatalf("Test %q failed: unexpected command %q", k, cmd.Command)
+			}
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		err := p.runChefCommand(context.Background(), o, c, "chef-client -z")
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if !started || reconnects != tc.Reconnects {
+			t.Fatalf("Test %q failed: expected the run to start and %d reconnections, got %t and %d",
+				k, tc.Reconnects, started, reconnects)
+		}
+		if cleaned != (poll == len(tc.Status)-1 && !tc.Drops[poll]) {
+			t.Fatalf("Test %q failed: the status file should only be removed once read, got %t", k, cleaned)
+		}
+		if tc.Exit != 0 {
+			if status, ok := exitStatus(err); !ok || status != tc.Exit {
+				t.Fatalf("Test %q failed: expected exit status %d, got %v", k, tc.Exit, err)
+			}
+		}
+		if err == nil {
+			output := strings.Join(lines, "\n")
+			if !strings.Contains(output, "Starting Chef Client\nConverging 2 resources\nChef Client finished") {
+				t.Fatalf("Test %q failed: the log was not followed in order:\n%s", k, output)
+			}
+		}
+	}
+}
+
+func TestResourceProvider_runDetachedCancelled(t *testing.T) {
+	defer func(d time.Duration) { detachedPollInterval = d }(detachedPollInterval)
+	detachedPollInterval = time.Hour
+
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"bundle_id":        "app",
+		"run_mode":         "detached",
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p := testProvisioner(t, fs, config)
+	if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := new(communicator.MockCommunicator)
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		if strings.HasPrefix(cmd.Command, "cat ") {
+			// The apply is interrupted while chef-client still runs
+			cancel()
+		}
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.runChefCommand(ctx, new(terraform.MockUIOutput), c, "chef-client -z")
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected the run to fail once the apply was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The run kept polling after the apply was cancelled")
+	}
+}
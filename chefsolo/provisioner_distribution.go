@@ -0,0 +1,171 @@
+package chefsolo
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	distributionChef   = "chef"
+	distributionCinc   = "cinc"
+	distributionCustom = "custom"
+
+	chefLicenseAccept          = "accept"
+	chefLicenseAcceptSilent    = "accept-silent"
+	chefLicenseAcceptNoPersist = "accept-no-persist"
+	// licensedMajorVersion is the first chef-client release asking for the
+	// license to be accepted
+	licensedMajorVersion = 15
+)
+
+var chefLicenses = []string{chefLicenseAccept, chefLicenseAcceptSilent, chefLicenseAcceptNoPersist}
+
+var majorVersion = regexp.MustCompile(`\d+`)
+
+// distribution describes where a chef-client distribution is downloaded
+// from and where it lives once installed
+type distribution struct {
+	// Product is the name of the product in the omnitruck API and of the
+	// package, empty when the distribution can only be installed from an
+	// installer_package
+	Product        string
+	Omnitruck      string
+	Repository     string
+	GPGKey         string
+	LinuxCmd       string
+	WindowsCmd     string
+	LinuxConfDir   string
+	WindowsConfDir string
+	// License is true when chef-client refuses to run until the Chef license
+	// is accepted
+	License bool
+}
+
+var distributions = map[string]distribution{
+	distributionChef: {
+		Product:        "chef",
+		Omnitruck:      "https://omnitruck.chef.io",
+		Repository:     "https://packages.chef.io/repos",
+		GPGKey:         "https://packages.chef.io/chef.asc",
+		LinuxCmd:       linuxChefCmd,
+		WindowsCmd:     windowsChefCmd,
+		LinuxConfDir:   linuxConfDir,
+		WindowsConfDir: windowsConfDir,
+		License:        true,
+	},
+	// Cinc publishes no package repository, install_method package requires
+	// package_repository and package_gpg_key to point to a mirror
+	distributionCinc: {
+		Product:        "cinc",
+		Omnitruck:      "https://omnitruck.cinc.sh",
+		LinuxCmd:       "/usr/bin/cinc-client",
+		WindowsCmd:     "cmd /c cinc-client",
+		LinuxConfDir:   "/opt/cinc/0",
+		WindowsConfDir: "C:/cinc",
+	},
+	distributionCustom: {
+		LinuxCmd:       linuxChefCmd,
+		WindowsCmd:     windowsChefCmd,
+		LinuxConfDir:   linuxConfDir,
+		WindowsConfDir: windowsConfDir,
+		License:        true,
+	},
+}
+
+func isValidDistribution(name string) bool {
+	_, ok := distributions[name]
+	return ok
+}
+
+func isValidChefLicense(license string) bool {
+	for _, l := range chefLicenses {
+		if l == license {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresLicense tells whether version asks for a chef-client recent enough
+// to require the license to be accepted, judging by its first major version.
+// No version means the latest, which requires it.
+func requiresLicense(v string) bool {
+	if anyVersion(v) {
+		return true
+	}
+	major, err := strconv.Atoi(majorVersion.FindString(v))
+	return err == nil && major >= licensedMajorVersion
+}
+
+// licenseArgs returns the arguments accepting the Chef license, if the
+// distribution and the chef-client version need it. The installed version
+// decides when the install found it, the version asked for otherwise, as
+// chef-client 14 and older reject the argument.
+func (p *provisioner) licenseArgs() string {
+	if p.ChefLicense == "" || !p.dist.License {
+		return ""
+	}
+	if p.installedChef != nil {
+		if p.installedChef.Segments()[0] < licensedMajorVersion {
+			return ""
+		}
+	} else if !requiresLicense(p.installVersion()) {
+		return ""
+	}
+	return " --chef-license " + p.quote(p.ChefLicense)
+}
+
+// configureDistribution fills the settings left empty with the defaults of
+// the distribution, and makes sure it can be installed the way asked
+func (p *provisioner) configureDistribution() error {
+	dist, ok := distributions[p.Distribution]
+	if !ok {
+		return fmt.Errorf("unsupported distribution: %s", p.Distribution)
+	}
+	p.dist = dist
+
+	if p.Distribution == distributionCustom && p.ChefClientPath == "" {
+		return fmt.Errorf("distribution %s requires chef_client_path", distributionCustom)
+	}
+	if p.PackageRepository == "" {
+		p.PackageRepository = dist.Repository
+	}
+	if p.PackageGPGKey == "" {
+		p.PackageGPGKey = dist.GPGKey
+	}
+
+	if p.SkipInstall {
+		return nil
+	}
+	switch {
+	case p.InstallerSource == installerSourceLocal && p.InstallerPackage != "":
+	case dist.Product == "":
+		return fmt.Errorf("distribution %s can only be installed from an installer_package, "+
+			"set installer_source %s and installer_package, or skip_install", p.Distribution, installerSourceLocal)
+	case p.InstallMethod == installMethodPackage && (p.PackageRepository == "" || p.PackageGPGKey == ""):
+		return fmt.Errorf("distribution %s has no package repository, install_method %s requires "+
+			"package_repository and package_gpg_key", p.Distribution, installMethodPackage)
+	}
+	return nil
+}
+
+// clientCmd returns the command running chef-client on the target os type
+func (p *provisioner) clientCmd() string {
+	if p.OSType == "windows" {
+		if p.ChefClientPath != "" {
+			return "cmd /c " + cmdQuote(p.ChefClientPath)
+		}
+		return p.dist.WindowsCmd
+	}
+	if p.ChefClientPath != "" {
+		return shellQuote(p.ChefClientPath)
+	}
+	return p.dist.LinuxCmd
+}
+
+// installScriptURL returns the url of the omnitruck install.sh script
+func (p *provisioner) installScriptURL() string {
+	return strings.TrimSuffix(p.dist.Omnitruck, "/") + "/install.sh"
+}
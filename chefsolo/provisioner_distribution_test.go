@@ -0,0 +1,233 @@
+package chefsolo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_distribution(t *testing.T) {
+	cases := map[string]struct {
+		Config     map[string]interface{}
+		Connection string
+		ChefCmd    string
+		ConfDir    string
+		InstallURL string
+		Repository string
+		Error      bool
+	}{
+		"Chef": {
+			Config:     map[string]interface{}{},
+			Connection: "ssh",
+			ChefCmd:    "/usr/bin/chef-client",
+			ConfDir:    "/opt/chef/0",
+			InstallURL: "https://omnitruck.chef.io/install.sh",
+			Repository: "https://packages.chef.io/repos",
+		},
+		"Cinc": {
+			Config:     map[string]interface{}{"distribution": "cinc"},
+			Connection: "ssh",
+			ChefCmd:    "/usr/bin/cinc-client",
+			ConfDir:    "/opt/cinc/0",
+			InstallURL: "https://omnitruck.cinc.sh/install.sh",
+		},
+		"Cinc on windows": {
+			Config:     map[string]interface{}{"distribution": "cinc"},
+			Connection: "winrm",
+			ChefCmd:    "cmd /c cinc-client",
+			ConfDir:    "C:/cinc",
+			InstallURL: "https://omnitruck.cinc.sh/install.sh",
+		},
+		"Cinc mirror": {
+			Config: map[string]interface{}{
+				"distribution":       "cinc",
+				"install_method":     "package",
+				"package_repository": "https://mirror.local/cinc",
+				"package_gpg_key":    "https://mirror.local/cinc.asc",
+			},
+			Connection: "ssh",
+			ChefCmd:    "/usr/bin/cinc-client",
+			ConfDir:    "/opt/cinc/0",
+			InstallURL: "https://omnitruck.cinc.sh/install.sh",
+			Repository: "https://mirror.local/cinc",
+		},
+		"Cinc package without mirror": {
+			Config: map[string]interface{}{
+				"distribution":   "cinc",
+				"install_method": "package",
+			},
+			Error: true,
+		},
+		"Custom path": {
+			Config: map[string]interface{}{
+				"distribution":     "custom",
+				"chef_client_path": "/opt/acme/bin/chef client",
+				"skip_install":     true,
+			},
+			Connection: "ssh",
+			ChefCmd:    "'/opt/acme/bin/chef client'",
+			ConfDir:    "/opt/chef/0",
+			InstallURL: "/install.sh",
+		},
+		"Custom path on windows": {
+			Config: map[string]interface{}{
+				"distribution":     "custom",
+				"chef_client_path": "C:/acme/bin/chef-client.bat",
+				"skip_install":     true,
+			},
+			Connection: "winrm",
+			ChefCmd:    "cmd /c C:/acme/bin/chef-client.bat",
+			ConfDir:    "C:/chef",
+			InstallURL: "/install.sh",
+		},
+		"Custom from a package": {
+			Config: map[string]interface{}{
+				"distribution":      "custom",
+				"chef_client_path":  "/opt/acme/bin/chef-client",
+				"installer_source":  "local",
+				"installer_package": "/packages/acme-chef-15.0.300-1.el7.x86_64.rpm",
+			},
+			Connection: "ssh",
+			ChefCmd:    "/opt/acme/bin/chef-client",
+			ConfDir:    "/opt/chef/0",
+			InstallURL: "/install.sh",
+		},
+		"Custom without path": {
+			Config: map[string]interface{}{
+				"distribution": "custom",
+				"skip_install": true,
+			},
+			Error: true,
+		},
+		"Custom without package": {
+			Config: map[string]interface{}{
+				"distribution":     "custom",
+				"chef_client_path": "/opt/acme/bin/chef-client",
+			},
+			Error: true,
+		},
+	}
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+			fs,
+		)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		state := &terraform.InstanceState{
+			Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{"type": tc.Connection}},
+		}
+		if err := p.configurePerOS(state); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if p.chefCmd != tc.ChefCmd {
+			t.Fatalf("Test %q failed: expected command %q, got %q", k, tc.ChefCmd, p.chefCmd)
+		}
+		if p.RemoteConfDir != tc.ConfDir {
+			t.Fatalf("Test %q failed: expected conf dir %s, got %s", k, tc.ConfDir, p.RemoteConfDir)
+		}
+		if url := p.installScriptURL(); url != tc.InstallURL {
+			t.Fatalf("Test %q failed: expected install url %s, got %s", k, tc.InstallURL, url)
+		}
+		if p.PackageRepository != tc.Repository {
+			t.Fatalf("Test %q failed: expected repository %q, got %q", k, tc.Repository, p.PackageRepository)
+		}
+	}
+}
+
+func TestRequiresLicense(t *testing.T) {
+	cases := map[string]bool{
+		"":         true,
+		"latest":   true,
+		"14.12.9":  false,
+		"15.0.300": true,
+		"~> 14.10": false,
+		">= 13":    false,
+		"~> 16":    true,
+	}
+	for v, expected := range cases {
+		if got := requiresLicense(v); got != expected {
+			t.Fatalf("requiresLicense(%q): expected %t, got %t", v, expected, got)
+		}
+	}
+}
+
+func TestResourceProvider_licenseArgs(t *testing.T) {
+	cases := map[string]struct {
+		Config    map[string]interface{}
+		Installed string
+		Args      string
+	}{
+		"Latest": {
+			Config: map[string]interface{}{},
+			Args:   " --chef-license accept",
+		},
+		"Pinned 14": {
+			Config: map[string]interface{}{"version": "14.10"},
+		},
+		"Pinned 15": {
+			Config: map[string]interface{}{"version": "15.0.300"},
+			Args:   " --chef-license accept",
+		},
+		"Constraint below 15": {
+			Config: map[string]interface{}{"version": "< 15", "version_policy": "constraint"},
+		},
+		"Installed 14": {
+			Config:    map[string]interface{}{"version": "13", "version_policy": "minimum"},
+			Installed: "14.12.9",
+		},
+		"Installed 15": {
+			Config:    map[string]interface{}{"version": "14", "version_policy": "minimum"},
+			Installed: "15.0.300",
+			Args:      " --chef-license accept",
+		},
+		"Cinc": {
+			Config: map[string]interface{}{"distribution": "cinc"},
+		},
+	}
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"chef_license":     "accept",
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		if tc.Installed != "" {
+			p.installedChef = version.Must(version.NewVersion(tc.Installed))
+		}
+
+		if args := p.licenseArgs(); args != tc.Args {
+			t.Fatalf("Test %q failed: expected %q, got %q", k, tc.Args, args)
+		}
+	}
+}
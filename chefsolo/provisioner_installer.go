@@ -0,0 +1,461 @@
+package chefsolo
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+const (
+	installerSourceRemote    = "remote"
+	installerSourceLocal     = "local"
+	defaultInstallerCacheDir = "~/.terraform.d/chefsolo-installers"
+)
+
+// installerClient bounds each step of the requests of the installer but not
+// the whole download, so a large package on a slow link still completes
+// while a stalled mirror can not hang the apply even without install_timeout.
+// The body of a response is bounded by installerIdleTimeout.
+var installerClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// installerIdleTimeout is how long reading a response may go without
+// receiving anything
+var installerIdleTimeout = time.Minute
+
+const installPackageScript = `
+$ErrorActionPreference = 'Stop'
+$package = %s
+$expected = %s
+
+$stream = [System.IO.File]::OpenRead($package)
+try {
+  $hash = [System.Security.Cryptography.SHA256]::Create().ComputeHash($stream)
+} finally {
+  $stream.Close()
+}
+$actual = ([System.BitConverter]::ToString($hash) -replace '-', '').ToLower()
+if ($actual -ne $expected) {
+  Remove-Item -Force $package
+  throw "Checksum mismatch for ${package}: expected $expected, got $actual"
+}
+
+Write-Host 'Installing Chef Client...'
+$process = Start-Process -FilePath msiexec -ArgumentList /qn, /i, $package -Wait -PassThru
+Remove-Item -Force $package
+if ($process.ExitCode -ne 0 -and $process.ExitCode -ne 3010) {
+  throw "msiexec failed with exit code $($process.ExitCode)"
+}
+`
+
+var (
+	// installerLock serializes the package downloads, so the instances of an
+	// apply wait for the first one to fetch the package instead of all
+	// downloading it. It is a channel so the waiting instances give up with
+	// their apply.
+	installerLock = make(chan struct{}, 1)
+	// resolvedPackages holds the packages already resolved by this process,
+	// keyed by their cache directory and metadata url
+	resolvedPackages = make(map[string]*chefPackage)
+)
+
+// chefPackage is a Chef Client package available on the Terraform host
+type chefPackage struct {
+	Path   string
+	SHA256 string
+}
+
+// packagePlatform describes the target machine as the omnitruck API expects it
+type packagePlatform struct {
+	Platform string
+	Version  string
+	Machine  string
+}
+
+// packageExtensions lists the supported package types for each os type
+var packageExtensions = map[string][]string{
+	"linux":   {".rpm", ".deb"},
+	"windows": {".msi"},
+}
+
+func isValidPackageExtension(file string) bool {
+	ext := strings.ToLower(path.Ext(file))
+	for _, exts := range packageExtensions {
+		for _, e := range exts {
+			if ext == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPackageExtension makes sure a user supplied package can be installed
+// on the target os type
+func (p *provisioner) checkPackageExtension() error {
+	if p.InstallerPackage == "" {
+		return nil
+	}
+	ext := strings.ToLower(path.Ext(p.InstallerPackage))
+	for _, e := range packageExtensions[p.OSType] {
+		if ext == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("installer_package %s can not be installed on %s, expected one of: %s",
+		p.InstallerPackage, p.OSType, strings.Join(packageExtensions[p.OSType], ", "))
+}
+
+// omnitruckPlatform maps the ID and VERSION_ID fields of /etc/os-release to
+// the platform names of the omnitruck API
+func omnitruckPlatform(id, version string) (string, string, error) {
+	major := strings.SplitN(version, ".", 2)[0]
+	switch id {
+	case "ubuntu":
+		return "ubuntu", version, nil
+	case "debian":
+		return "debian", major, nil
+	case "rhel", "centos", "rocky", "almalinux", "ol", "scientific":
+		return "el", major, nil
+	case "amzn":
+		return "amazon", major, nil
+	case "sles", "sled", "opensuse-leap":
+		return "sles", major, nil
+	case "fedora":
+		return "fedora", major, nil
+	}
+	return "", "", fmt.Errorf("no Chef Client package known for platform %q, set installer_package instead", id)
+}
+
+// linuxPackagePlatform detects the distribution and architecture of the target
+func (p *provisioner) linuxPackagePlatform(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) (packagePlatform, error) {
+	out, err := p.runRemoteAsUserOutput(ctx, o, comm, `uname -m && . /etc/os-release && echo "$ID" "$VERSION_ID"`)
+	if err != nil {
+		return packagePlatform{}, fmt.Errorf("error detecting the platform of the machine: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return packagePlatform{}, fmt.Errorf("error detecting the platform of the machine: unexpected output %q", out)
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 2 {
+		return packagePlatform{}, fmt.Errorf("error detecting the platform of the machine: unexpected output %q", out)
+	}
+	platform, version, err := omnitruckPlatform(fields[0], fields[1])
+	if err != nil {
+		return packagePlatform{}, err
+	}
+	return packagePlatform{Platform: platform, Version: version, Machine: strings.TrimSpace(lines[0])}, nil
+}
+
+// windowsPackagePlatform detects the architecture of the target, the same
+// MSI being used by every supported Windows version
+func (p *provisioner) windowsPackagePlatform(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) (packagePlatform, error) {
+	out, err := p.runRemoteOutput(ctx, o, comm, "cmd /c echo %PROCESSOR_ARCHITECTURE%")
+	if err != nil {
+		return packagePlatform{}, fmt.Errorf("error detecting the platform of the machine: %v", err)
+	}
+	machine := "x86_64"
+	if strings.TrimSpace(out) == "x86" {
+		machine = "i386"
+	}
+	return packagePlatform{Platform: "windows", Version: "2012r2", Machine: machine}, nil
+}
+
+// localPackage returns the package to install on a machine of the given
+// platform. A user supplied package is used as is, otherwise the package is
+// resolved with the omnitruck API and downloaded once into the installer
+// cache.
+func (p *provisioner) localPackage(ctx context.Context, o terraform.UIOutput,
+	platform packagePlatform) (*chefPackage, error) {
+	if p.InstallerPackage != "" {
+		sum, err := p.fileSHA256(p.InstallerPackage)
+		if err != nil {
+			return nil, err
+		}
+		return &chefPackage{Path: p.InstallerPackage, SHA256: sum}, nil
+	}
+
+	query := url.Values{}
+	query.Set("p", platform.Platform)
+	query.Set("pv", platform.Version)
+	query.Set("m", platform.Machine)
+	query.Set("v", versionLatest)
+	if v := p.installVersion(); v != "" {
+		query.Set("v", v)
+	}
+	metadataURL := fmt.Sprintf("%s/%s/%s/metadata?%s", strings.TrimSuffix(p.dist.Omnitruck, "/"),
+		url.PathEscape(p.Channel), url.PathEscape(p.dist.Product), query.Encode())
+
+	select {
+	case installerLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error waiting for another instance to download Chef Client: %v", ctx.Err())
+	}
+	defer func() { <-installerLock }()
+
+	if pkg, ok := resolvedPackages[p.InstallerCacheDir+" "+metadataURL]; ok {
+		if _, err := p.os.Stat(pkg.Path); err == nil {
+			return pkg, nil
+		}
+	}
+
+	packageURL, sum, err := fetchPackageMetadata(ctx, metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(packageURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing package url %s: %v", packageURL, err)
+	}
+	name := path.Base(u.Path)
+	if !isValidPackageExtension(name) {
+		return nil, fmt.Errorf("unsupported Chef Client package %s", packageURL)
+	}
+
+	// Packages are stored under their checksum, so a cached package is never
+	// mistaken for another version
+	pkg := &chefPackage{Path: filepath.Join(p.InstallerCacheDir, sum, name), SHA256: sum}
+	if cached, err := p.fileSHA256(pkg.Path); err == nil && cached == sum {
+		o.Output("Using cached Chef Client package " + pkg.Path)
+	} else {
+		o.Output("Downloading Chef Client package " + packageURL)
+		if err := p.downloadPackage(ctx, packageURL, pkg); err != nil {
+			return nil, err
+		}
+	}
+	resolvedPackages[p.InstallerCacheDir+" "+metadataURL] = pkg
+	return pkg, nil
+}
+
+// fetchPackageMetadata queries the omnitruck API for the url and checksum of
+// a package
+func fetchPackageMetadata(ctx context.Context, metadataURL string) (string, string, error) {
+	resp, err := httpGet(ctx, metadataURL)
+	if err != nil {
+		return "", "", fmt.Errorf("error resolving Chef Client package: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("error resolving Chef Client package: %s returned %s", metadataURL, resp.Status)
+	}
+
+	// The metadata is made of "key\tvalue" lines
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if kv := strings.Fields(scanner.Text()); len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("error reading Chef Client package metadata: %v", err)
+	}
+	if fields["url"] == "" || len(fields["sha256"]) != sha256.Size*2 {
+		return "", "", fmt.Errorf("error resolving Chef Client package: no url or sha256 in the metadata of %s", metadataURL)
+	}
+	return fields["url"], strings.ToLower(fields["sha256"]), nil
+}
+
+// httpGet fetches rawURL with the installer client, giving up when ctx ends
+// or when the body stops coming for installerIdleTimeout
+func httpGet(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := installerClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleBody{ReadCloser: resp.Body, timer: time.AfterFunc(installerIdleTimeout, cancel), cancel: cancel}
+	return resp, nil
+}
+
+// idleBody cancels its request when nothing is read for installerIdleTimeout
+type idleBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(installerIdleTimeout)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// downloadPackage downloads a package into the installer cache, keeping it
+// only when its checksum matches
+func (p *provisioner) downloadPackage(ctx context.Context, packageURL string, pkg *chefPackage) error {
+	dir := filepath.Dir(pkg.Path)
+	if err := p.os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating installer cache directory %s: %v", dir, err)
+	}
+
+	resp, err := httpGet(ctx, packageURL)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", packageURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading %s: %s", packageURL, resp.Status)
+	}
+
+	f, err := afero.TempFile(p.os, dir, ".download-")
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", pkg.Path, err)
+	}
+	defer p.os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", packageURL, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != pkg.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", packageURL, pkg.SHA256, sum)
+	}
+	if err := p.os.Rename(f.Name(), pkg.Path); err != nil {
+		return fmt.Errorf("error storing %s: %v", pkg.Path, err)
+	}
+	return nil
+}
+
+func (p *provisioner) fileSHA256(file string) (string, error) {
+	f, err := p.os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %v", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error reading %s: %v", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadPackage copies the package to the machine
+func (p *provisioner) uploadPackage(o terraform.UIOutput, comm communicator.Communicator, pkg *chefPackage,
+	remotePackage string) error {
+	f, err := p.os.Open(pkg.Path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", pkg.Path, err)
+	}
+	defer f.Close()
+
+	o.Output(fmt.Sprintf("Uploading %s (sha256 %s)", remotePackage, pkg.SHA256))
+	if err := comm.Upload(remotePackage, f); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", remotePackage, err)
+	}
+	return nil
+}
+
+// linuxInstallChefPackage installs Chef Client from a package uploaded from
+// the Terraform host, for machines without access to the internet
+func (p *provisioner) linuxInstallChefPackage(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	var platform packagePlatform
+	if p.InstallerPackage == "" {
+		var err error
+		if platform, err = p.linuxPackagePlatform(ctx, o, comm); err != nil {
+			return err
+		}
+	}
+	pkg, err := p.localPackage(ctx, o, platform)
+	if err != nil {
+		return err
+	}
+
+	staging, err := p.createStagingDir(ctx, o, comm)
+	if err != nil {
+		return err
+	}
+	defer p.removeStagingDir(ctx, o, comm, staging)
+
+	remotePackage := path.Join(staging, path.Base(filepath.ToSlash(pkg.Path)))
+	if err := p.uploadPackage(o, comm, pkg, remotePackage); err != nil {
+		return err
+	}
+	verify := fmt.Sprintf("echo %s | sha256sum -c -", shellQuote(pkg.SHA256+"  "+remotePackage))
+	if err := p.runRemoteAsUser(ctx, o, comm, verify); err != nil {
+		return fmt.Errorf("verifying %s failed: %v", remotePackage, err)
+	}
+
+	install := shellJoin("dpkg", "-i", remotePackage)
+	if strings.ToLower(path.Ext(remotePackage)) == ".rpm" {
+		install = shellJoin("rpm", "-Uvh", "--oldpackage", "--replacepkgs", remotePackage)
+	}
+	return p.runRemote(ctx, o, comm, install)
+}
+
+// windowsInstallChefPackage installs Chef Client from an MSI uploaded from
+// the Terraform host, for machines without access to the internet
+func (p *provisioner) windowsInstallChefPackage(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	var platform packagePlatform
+	if p.InstallerPackage == "" {
+		var err error
+		if platform, err = p.windowsPackagePlatform(ctx, o, comm); err != nil {
+			return err
+		}
+	}
+	pkg, err := p.localPackage(ctx, o, platform)
+	if err != nil {
+		return err
+	}
+
+	remoteDir := path.Dir(comm.ScriptPath())
+	remotePackage := path.Join(remoteDir, path.Base(filepath.ToSlash(pkg.Path)))
+	if err := p.uploadPackage(o, comm, pkg, remotePackage); err != nil {
+		return err
+	}
+
+	script := path.Join(remoteDir, "InstallChefPackage.ps1")
+	content := fmt.Sprintf(installPackageScript, powershellQuote(remotePackage), powershellQuote(pkg.SHA256))
+	if err := comm.UploadScript(script, strings.NewReader(content)); err != nil {
+		return fmt.Errorf("uploading InstallChefPackage.ps1 failed: %v", err)
+	}
+
+	installCmd := fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File %s", cmdQuote(script))
+	return p.runRemote(ctx, o, comm, installCmd)
+}
@@ -0,0 +1,246 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestOmnitruckPlatform(t *testing.T) {
+	cases := map[string]struct {
+		ID       string
+		Version  string
+		Platform string
+		PV       string
+		Error    bool
+	}{
+		"ubuntu":  {ID: "ubuntu", Version: "18.04", Platform: "ubuntu", PV: "18.04"},
+		"debian":  {ID: "debian", Version: "9", Platform: "debian", PV: "9"},
+		"centos":  {ID: "centos", Version: "7", Platform: "el", PV: "7"},
+		"rhel":    {ID: "rhel", Version: "8.2", Platform: "el", PV: "8"},
+		"amazon":  {ID: "amzn", Version: "2", Platform: "amazon", PV: "2"},
+		"sles":    {ID: "sles", Version: "15.1", Platform: "sles", PV: "15"},
+		"unknown": {ID: "plan9", Version: "4", Error: true},
+	}
+
+	for k, tc := range cases {
+		platform, version, err := omnitruckPlatform(tc.ID, tc.Version)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if platform != tc.Platform || version != tc.PV {
+			t.Fatalf("Test %q failed: expected %s %s, got %s %s", k, tc.Platform, tc.PV, platform, version)
+		}
+	}
+}
+
+func TestResourceProvider_localPackage(t *testing.T) {
+	content := "chef package"
+	downloads := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/stable/chef/metadata", func(w http.ResponseWriter, r *http.Request) {
+		sum := testSum(content)
+		if r.URL.Query().Get("pv") == "6" {
+			sum = testSum("something else")
+		}
+		fmt.Fprintf(w, "sha1\tabcdef\nsha256\t%s\nurl\t%s/files/chef-15.0.300-1.el7.x86_64.rpm\nversion\t15.0.300\n",
+			sum, server.URL)
+	})
+	mux.HandleFunc("/files/chef-15.0.300-1.el7.x86_64.rpm", func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		fmt.Fprint(w, content)
+	})
+
+	defer func() { resolvedPackages = make(map[string]*chefPackage) }()
+
+	config := map[string]interface{}{
+		"instance_id":         `toto`,
+		"chef_module_path":    `/input`,
+		"output_dir":          `/output`,
+		"nodes":               []string{`{ "id":"toto"}`},
+		"target_node":         `{ "id":"toto"}`,
+		"installer_source":    "local",
+		"installer_cache_dir": "/installers",
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	p.dist.Omnitruck = server.URL
+	o := new(terraform.MockUIOutput)
+	platform := packagePlatform{Platform: "el", Version: "7", Machine: "x86_64"}
+
+	for i := 0; i < 2; i++ {
+		pkg, err := p.localPackage(context.Background(), o, platform)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected := "/installers/" + testSum(content) + "/chef-15.0.300-1.el7.x86_64.rpm"
+		if pkg.Path != expected || pkg.SHA256 != testSum(content) {
+			t.Fatalf("expected %s, got %s (sha256 %s)", expected, pkg.Path, pkg.SHA256)
+		}
+		// The next apply only finds the package in the cache
+		resolvedPackages = make(map[string]*chefPackage)
+	}
+	if downloads != 1 {
+		t.Fatalf("expected the package to be downloaded once, got %d downloads", downloads)
+	}
+
+	platform.Version = "6"
+	if _, err := p.localPackage(context.Background(), o, platform); err == nil {
+		t.Fatalf("expected a checksum mismatch to fail")
+	}
+	if files, _ := afero.ReadDir(fs, "/installers/"+testSum("something else")); len(files) != 0 {
+		t.Fatalf("expected the corrupted download to be removed, got %d files", len(files))
+	}
+}
+
+func TestResourceProvider_localPackageStalled(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mirror never answers
+		select {
+		case <-r.Context().Done():
+		case <-stalled:
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	config := map[string]interface{}{
+		"instance_id":         `toto`,
+		"chef_module_path":    `/input`,
+		"output_dir":          `/output`,
+		"nodes":               []string{`{ "id":"toto"}`},
+		"target_node":         `{ "id":"toto"}`,
+		"installer_source":    "local",
+		"installer_cache_dir": "/installers",
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p := testProvisioner(t, fs, config)
+	p.dist.Omnitruck = server.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	platform := packagePlatform{Platform: "el", Version: "7", Machine: "x86_64"}
+	if _, err := p.localPackage(ctx, new(terraform.MockUIOutput), platform); err == nil {
+		t.Fatalf("expected a stalled mirror to fail once the apply context ends")
+	}
+}
+
+func TestHttpGetIdleBody(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mirror sends part of the package and then stops
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-stalled:
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	defer func(timeout time.Duration) { installerIdleTimeout = timeout }(installerIdleTimeout)
+	installerIdleTimeout = 50 * time.Millisecond
+
+	resp, err := httpGet(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("expected the headers to arrive, got %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatalf("expected a stalled body to fail")
+	}
+}
+
+func TestResourceProvider_linuxInstallChefPackage(t *testing.T) {
+	cases := map[string]struct {
+		Config   map[string]interface{}
+		Package  string
+		Commands map[string]bool
+	}{
+		"rpm": {
+			Config: map[string]interface{}{
+				"instance_id":       `toto`,
+				"chef_module_path":  `/input`,
+				"output_dir":        `/output`,
+				"nodes":             []string{`{ "id":"toto"}`},
+				"target_node":       `{ "id":"toto"}`,
+				"use_sudo":          true,
+				"installer_source":  "local",
+				"installer_package": "/packages/chef-15.0.300-1.el7.x86_64.rpm",
+			},
+			Package: "chef-15.0.300-1.el7.x86_64.rpm",
+			Commands: map[string]bool{
+				"mktemp -d /tmp/chefsolo.XXXXXXXXXX": true,
+				"echo '" + testSum("package") + "  " + testStagingDir + "/chef-15.0.300-1.el7.x86_64.rpm' | sha256sum -c -": true,
+				"sudo bash -c 'rpm -Uvh --oldpackage --replacepkgs " + testStagingDir + "/chef-15.0.300-1.el7.x86_64.rpm'":  true,
+				"rm -rf " + testStagingDir: true,
+			},
+		},
+
+		"deb": {
+			Config: map[string]interface{}{
+				"instance_id":       `toto`,
+				"chef_module_path":  `/input`,
+				"output_dir":        `/output`,
+				"nodes":             []string{`{ "id":"toto"}`},
+				"target_node":       `{ "id":"toto"}`,
+				"use_sudo":          false,
+				"installer_source":  "local",
+				"installer_package": "/packages/chef_15.0.300-1_amd64.deb",
+			},
+			Package: "chef_15.0.300-1_amd64.deb",
+			Commands: map[string]bool{
+				"mktemp -d /tmp/chefsolo.XXXXXXXXXX": true,
+				"echo '" + testSum("package") + "  " + testStagingDir + "/chef_15.0.300-1_amd64.deb' | sha256sum -c -": true,
+				"dpkg -i " + testStagingDir + "/chef_15.0.300-1_amd64.deb":                                             true,
+				"rm -rf " + testStagingDir: true,
+			},
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+	c := new(communicator.MockCommunicator)
+
+	for k, tc := range cases {
+		c.CommandFunc = stagingCommandFunc(tc.Commands)
+		c.Uploads = map[string]string{testStagingDir + "/" + tc.Package: "package"}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		afero.WriteFile(fs, "/packages/"+tc.Package, []byte("package"), 0644)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, tc.Config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		if err := p.installChefClient(context.Background(), o, c); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+	}
+}
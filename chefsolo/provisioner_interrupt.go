@@ -0,0 +1,130 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	chefPidFile = "chef-client.pid"
+	// The pid is only trusted when the process still runs this bundle, it may
+	// have been reused since the last run
+	linuxStopChefCmd = `pid=$(cat %[1]s 2> /dev/null) || exit 0
+grep -aqF %[2]s /proc/"$pid"/cmdline 2> /dev/null || exit 0
+kill -TERM "$pid"
+for i in $(seq %[3]d); do kill -0 "$pid" 2> /dev/null || exit 0; sleep 1; done
+kill -KILL "$pid"`
+	// taskkill without /F asks the processes to close, those still running
+	// after the grace period are killed. The command line of this very
+	// command, and of the cmd.exe running it, also matches the pattern.
+	windowsStopChefCmd = `powershell -NoProfile -Command "$p = @(Get-CimInstance Win32_Process | ` +
+		`Where-Object { $_.CommandLine -like %[1]s -and $_.ProcessId -ne $PID -and $_.Name -ne 'cmd.exe' }); ` +
+		`if ($p.Count -eq 0) { exit 0 }; $p | ForEach-Object { taskkill /PID $_.ProcessId | Out-Null }; ` +
+		`$end = (Get-Date).AddSeconds(%[2]d); ` +
+		`while ((Get-Process -Id $p.ProcessId -ErrorAction SilentlyContinue) -and (Get-Date) -lt $end) { Start-Sleep 1 }; ` +
+		`Get-Process -Id $p.ProcessId -ErrorAction SilentlyContinue | Stop-Process -Force"`
+)
+
+// parseTimeout parses an optional duration, empty meaning no timeout
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// waitRemote waits for a remote command, giving up when ctx ends
+func (p *provisioner) waitRemote(ctx context.Context, cmd *remote.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for %q: %v", cmd.Command, ctx.Err())
+	}
+}
+
+// inPhase runs f with ctx limited to timeout when it is set. When ctx ends
+// before f is done the connection is dropped, which also aborts blocked
+// uploads, and the machine is cleaned up.
+func (p *provisioner) inPhase(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	phase string, timeout time.Duration, f func(context.Context) error) error {
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			comm.Disconnect()
+		case <-stop:
+		}
+	}()
+	err := f(ctx)
+	close(stop)
+	<-done
+
+	switch {
+	case ctx.Err() == nil:
+		return err
+	case ctx.Err() == context.DeadlineExceeded && timeout > 0:
+		err = fmt.Errorf("%s timed out after %s", phase, timeout)
+	default:
+		err = fmt.Errorf("%s interrupted", phase)
+	}
+	o.Output(fmt.Sprintf("%v, cleaning up the machine...", err))
+	p.abortRemote(o, comm)
+	return err
+}
+
+// abortRemote reconnects after an interrupted phase to stop chef-client and
+// remove the staging directories left behind
+func (p *provisioner) abortRemote(o terraform.UIOutput, comm communicator.Communicator) {
+	ctx, cancel := context.WithTimeout(context.Background(), comm.Timeout()+p.GracePeriod)
+	defer cancel()
+
+	if err := p.reconnect(ctx, o, comm); err != nil {
+		o.Output(fmt.Sprintf("Warning: unable to clean up the machine: %v", err))
+		return
+	}
+	if err := p.stopChefClient(ctx, o, comm); err != nil {
+		o.Output(fmt.Sprintf("Warning: stopping chef-client failed: %v", err))
+	}
+	for _, staging := range append([]string(nil), p.stagingDirs...) {
+		p.removeStagingDir(ctx, o, comm, staging)
+	}
+}
+
+// stopChefClient stops the chef-client run of the bundle. On linux it is sent
+// SIGTERM through its pid file, then SIGKILL when it is still running after
+// the grace period. Windows has no pid file, the processes running the bundle
+// are found by their command line, asked to close with taskkill and killed
+// after the grace period.
+func (p *provisioner) stopChefClient(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator) error {
+	clientRb := path.Join(p.DefaultConfDir, clienrb)
+	if p.OSType == "windows" {
+		err := p.runRemote(ctx, o, comm, fmt.Sprintf(windowsStopChefCmd, powershellQuote("*"+clientRb+"*"),
+			int(p.GracePeriod/time.Second)))
+		if p.detachedRun != "" {
+			p.cleanupDetached(ctx, o, comm)
+		}
+		return err
+	}
+	return p.runRemote(ctx, o, comm, fmt.Sprintf(linuxStopChefCmd, shellQuote(path.Join(p.DefaultConfDir, chefPidFile)),
+		shellQuote(clientRb), int(p.GracePeriod/time.Second)))
+}
@@ -0,0 +1,118 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_inPhase(t *testing.T) {
+	stop := fmt.Sprintf(linuxStopChefCmd, "/opt/chef/0/app/chef-client.pid", "/opt/chef/0/app/client.rb", 5)
+
+	cases := map[string]struct {
+		Config  map[string]interface{}
+		Timeout time.Duration
+		Cancel  bool
+		Hang    bool
+		Error   string
+		Cleanup bool
+	}{
+		"Done in time": {
+			Timeout: time.Minute,
+		},
+		"No timeout": {},
+		"Timeout": {
+			Timeout: 50 * time.Millisecond,
+			Hang:    true,
+			Error:   "install timed out after 50ms",
+			Cleanup: true,
+		},
+		"Interrupted": {
+			Cancel:  true,
+			Hang:    true,
+			Error:   "install interrupted",
+			Cleanup: true,
+		},
+	}
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"bundle_id":        "app",
+			"grace_period":     "5s",
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		var mu sync.Mutex
+		commands := make(map[string]bool)
+		disconnects := 0
+		c := new(communicator.MockCommunicator)
+		c.DisconnectFunc = func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			disconnects++
+			return nil
+		}
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			mu.Lock()
+			defer mu.Unlock()
+			commands[cmd.Command] = true
+			switch {
+			case strings.HasPrefix(cmd.Command, "mktemp -d "):
+				io.WriteString(cmd.Stdout, testStagingDir+"\n")
+			case cmd.Command == "chef-client" && tc.Hang:
+				// Never completes
+				return nil
+			}
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.Cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		o := new(terraform.MockUIOutput)
+		err := p.inPhase(ctx, o, c, "install", tc.Timeout, func(ctx context.Context) error {
+			staging, err := p.createStagingDir(ctx, o, c)
+			if err != nil {
+				return err
+			}
+			defer p.removeStagingDir(ctx, o, c, staging)
+			return p.runRemote(ctx, o, c, "chef-client")
+		})
+		cancel()
+
+		if tc.Error == "" && err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if tc.Error != "" && (err == nil || err.Error() != tc.Error) {
+			t.Fatalf("Test %q failed: expected error %q, got %v", k, tc.Error, err)
+		}
+		if commands[stop] != tc.Cleanup || (disconnects > 0) != tc.Cleanup {
+			t.Fatalf("Test %q failed: expected cleanup %t, got stop %t and %d disconnections",
+				k, tc.Cleanup, commands[stop], disconnects)
+		}
+		if !commands["rm -rf "+testStagingDir] || len(p.stagingDirs) != 0 {
+			t.Fatalf("Test %q failed: the staging directory was not removed: %v", k, p.stagingDirs)
+		}
+	}
+}
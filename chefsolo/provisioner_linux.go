@@ -2,23 +2,33 @@ package chefsolo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/hashicorp/terraform/communicator"
 	"github.com/hashicorp/terraform/terraform"
 	"path"
 	"strings"
 	"text/template"
+	"time"
 )
 
 const (
-	chmod         = "find %s -maxdepth 1 -type f -exec /bin/chmod -R %d {} +"
-	installURL    = "https://omnitruck.chef.io/install.sh"
-	reloadDeamon  = "systemctl daemon-reload"
-	serviceName   = "chef-run.service"
+	chmod        = "find %s -maxdepth 1 -type f -exec /bin/chmod -R %d {} +"
+	reloadDeamon = "systemctl daemon-reload"
+	// serviceUnit names the unit of a bundle, so the bundles of a machine
+	// each keep their own
+	serviceUnit   = "chef-run-%s.service"
 	enableService = "systemctl enable %s"
 	servicePath   = "/etc/systemd/system/"
+	// stagingTemplate is the mktemp template of the staging directories
+	stagingTemplate = "chefsolo.XXXXXXXXXX"
+	installAttempts = 5
 )
 
+// installRetryInterval is the wait after the first failed download, doubled
+// after each attempt
+var installRetryInterval = 2 * time.Second
+
 const chefService = `
 [Unit]
 Description=Run chef client each time the machine reboot
@@ -37,93 +47,255 @@ RemainAfterExit=true
 WantedBy=multi-user.target
 `
 
-func (p *provisioner) linuxInstallChefClient(o terraform.UIOutput, comm communicator.Communicator) error {
-	// Build up the command prefix
+// proxyEnv returns the environment prefix passing the proxy settings to the
+// remote commands which reach the internet
+func (p *provisioner) proxyEnv() string {
 	prefix := ""
 	if p.HTTPProxy != "" {
-		prefix += fmt.Sprintf("http_proxy='%s' ", p.HTTPProxy)
+		prefix += "http_proxy=" + shellQuote(p.HTTPProxy) + " "
 	}
 	if p.HTTPSProxy != "" {
-		prefix += fmt.Sprintf("https_proxy='%s' ", p.HTTPSProxy)
+		prefix += "https_proxy=" + shellQuote(p.HTTPSProxy) + " "
 	}
 	if len(p.NOProxy) > 0 {
-		prefix += fmt.Sprintf("no_proxy='%s' ", strings.Join(p.NOProxy, ","))
+		prefix += "no_proxy=" + shellQuote(strings.Join(p.NOProxy, ",")) + " "
 	}
-	if err := p.runMultipleCommands(o, comm, []string{
-		fmt.Sprintf("%scurl -LO %s", prefix, installURL),
-		fmt.Sprintf("%sbash ./install.sh -v %q -c %s", prefix, p.Version, p.Channel),
-		fmt.Sprintf("%srm -f install.sh", prefix),
-	}); err != nil {
+	return prefix
+}
+
+// downloadCommand returns the command fetching url into file with the first
+// download tool available on the machine
+func (p *provisioner) downloadCommand(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator, url,
+	file string) (string, error) {
+	out, err := p.runRemoteAsUserOutput(ctx, o, comm, "command -v curl wget || true")
+	if err != nil {
+		return "", fmt.Errorf("error looking for a download tool: %v", err)
+	}
+	tools := make(map[string]bool)
+	for _, tool := range strings.Fields(out) {
+		tools[path.Base(tool)] = true
+	}
+	switch {
+	case tools["curl"]:
+		return p.proxyEnv() + shellJoin("curl", "-fsSL", "-o", file, url), nil
+	case tools["wget"]:
+		return p.proxyEnv() + shellJoin("wget", "-q", "-O", file, url), nil
+	}
+	return "", fmt.Errorf("neither curl nor wget is available on the machine to download %s", url)
+}
+
+// runWithRetries runs a command as the connecting user until it succeeds,
+// waiting longer after each failure
+func (p *provisioner) runWithRetries(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	interval := installRetryInterval
+	var err error
+	for attempt := 1; attempt <= installAttempts; attempt++ {
+		if err = p.runRemoteAsUser(ctx, o, comm, command); err == nil {
+			return nil
+		}
+		if attempt < installAttempts {
+			o.Output(fmt.Sprintf("Attempt %d/%d failed: %v, retrying in %s", attempt, installAttempts, err, interval))
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return fmt.Errorf("%v, not retrying: %v", err, ctx.Err())
+			}
+			interval *= 2
+		}
+	}
+	return err
+}
+
+func (p *provisioner) linuxInstallChefClient(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	if p.InstallMethod == installMethodPackage {
+		return p.linuxInstallChefFromRepository(ctx, o, comm)
+	}
+
+	// Download and run the installer in a private directory, so nothing is
+	// left behind in the working directory when something fails
+	staging, err := p.createStagingDir(ctx, o, comm)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer p.removeStagingDir(ctx, o, comm, staging)
+
+	installURL := p.installScriptURL()
+	script := path.Join(staging, "install.sh")
+	download, err := p.downloadCommand(ctx, o, comm, installURL, script)
+	if err != nil {
+		return err
+	}
+	if err := p.runWithRetries(ctx, o, comm, download); err != nil {
+		return fmt.Errorf("downloading %s failed: %v", installURL, err)
+	}
+
+	if p.InstallerSHA256 != "" {
+		verify := fmt.Sprintf("echo %s | sha256sum -c -", shellQuote(p.InstallerSHA256+"  "+script))
+		if err := p.runRemoteAsUser(ctx, o, comm, verify); err != nil {
+			return fmt.Errorf("verifying %s failed: %v", installURL, err)
+		}
+	}
+
+	return p.runRemote(ctx, o, comm, p.proxyEnv()+shellJoin("bash", script, "-v", p.installVersion(), "-c", p.Channel))
 }
 
-func (p *provisioner) preUploadDirectory(o terraform.UIOutput, comm communicator.Communicator, dir string) error {
+func (p *provisioner) preUploadDirectory(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	dir string) error {
 	// Make sure the config directory exists
-	commands := []string{"mkdir -p " + dir}
-	// Make sure we have enough rights to upload the files if using sudo
-	if p.useSudo {
-		commands = append(commands, "chmod -R 777 "+dir)
-	}
-	if err := p.runMultipleCommands(o, comm, commands); err != nil {
+	if err := p.runRemote(ctx, o, comm, shellJoin("mkdir", "-p", dir)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *provisioner) postUploadDirectory(o terraform.UIOutput, comm communicator.Communicator, dir string) error {
+// postUploadDirectory moves the files uploaded to the staging directory into
+// dir, and gives dir its owner and modes
+func (p *provisioner) postUploadDirectory(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	staging, dir string) error {
 	if !p.useSudo {
 		return nil
 	}
-	if err := p.runMultipleCommands(o, comm, []string{
-		fmt.Sprintf("chmod -R 755 %s", dir),
-		fmt.Sprintf(chmod, dir, 600),
-		fmt.Sprintf("chown -R root.root %s", dir),
+	if err := p.runMultipleCommands(ctx, o, comm, []string{
+		shellJoin("cp", "-R", staging+"/.", dir+"/"),
+		shellJoin("chown", "-R", p.RemoteOwner+":"+p.RemoteGroup, dir),
+		shellJoin("chmod", "-R", "u=rwX,g=rX,o=", dir),
+		fmt.Sprintf(chmod, shellQuote(dir), 600),
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *provisioner) linuxUploadConfigFiles(o terraform.UIOutput, comm communicator.Communicator) error {
+// createStagingDir creates a directory only the connecting user can access,
+// where files are uploaded before being moved into place with privileges
+func (p *provisioner) createStagingDir(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) (string, error) {
+	out, err := p.runRemoteAsUserOutput(ctx, o, comm,
+		shellJoin("mktemp", "-d", path.Join(p.RemoteTmpDir, stagingTemplate)))
+	if err != nil {
+		return "", fmt.Errorf("error creating staging directory in %s: %v", p.RemoteTmpDir, err)
+	}
+	staging := strings.TrimSpace(out)
+	if !strings.HasPrefix(staging, p.RemoteTmpDir+"/") || strings.ContainsAny(staging, "\n\r") {
+		return "", fmt.Errorf("error creating staging directory in %s: unexpected output %q", p.RemoteTmpDir, out)
+	}
+	// Remembered until removed, for an interrupted apply to clean it up
+	p.stagingDirs = append(p.stagingDirs, staging)
+	return staging, nil
+}
+
+func (p *provisioner) removeStagingDir(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	staging string) {
+	if err := p.runRemoteAsUser(ctx, o, comm, shellJoin("rm", "-rf", staging)); err != nil {
+		o.Output(fmt.Sprintf("Warning: removing staging directory %s failed: %v", staging, err))
+		return
+	}
+	for i, dir := range p.stagingDirs {
+		if dir == staging {
+			p.stagingDirs = append(p.stagingDirs[:i], p.stagingDirs[i+1:]...)
+			break
+		}
+	}
+}
 
-	// Make sure we have enough rights to upload the files if using sudo
-	if err := p.preUploadDirectory(o, comm, linuxConfDir); err != nil {
+func (p *provisioner) linuxUploadConfigFiles(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	if err := p.preUploadDirectory(ctx, o, comm, p.DefaultConfDir); err != nil {
 		return err
 	}
 
+	// Without privileges everything is uploaded in place, otherwise it goes
+	// through a staging directory so the config directory is never writable
+	// by the connecting user
+	uploadDir := p.DefaultConfDir
+	if p.useSudo {
+		staging, err := p.createStagingDir(ctx, o, comm)
+		if err != nil {
+			return err
+		}
+		defer p.removeStagingDir(ctx, o, comm, staging)
+		uploadDir = staging
+	}
+
 	o.Output("Uploading client conf")
-	if err := p.uploadClientConf(comm, linuxConfDir); err != nil {
+	if err := p.uploadClientConf(comm, uploadDir); err != nil {
 		return err
 	}
 
-	configDir := path.Join(linuxConfDir, p.BaseOutputDir)
+	configDir := path.Join(p.DefaultConfDir, p.BaseOutputDir)
 
 	o.Output("Deploying " + configDir)
 
-	if err := p.uploadDirectory(o, comm, p.OutputDir, linuxConfDir); err != nil {
+	if p.UploadMode == uploadModeArchive || p.UploadMode == uploadModeSync {
+		if err := p.uploadArchive(ctx, o, comm, p.DefaultConfDir, uploadDir); err != nil {
+			return err
+		}
+	} else {
+		if err := p.uploadDirectory(o, comm, p.OutputDir, uploadDir); err != nil {
+			return err
+		}
+
+		for _, resource := range p.Resources {
+			if err := p.uploadDirectory(o, comm, resource.(string), path.Join(uploadDir, p.BaseOutputDir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := p.postUploadDirectory(ctx, o, comm, uploadDir, p.DefaultConfDir); err != nil {
 		return err
 	}
 
-	for _, resource := range p.Resources {
-		if err := p.uploadDirectory(o, comm, resource.(string), path.Join(linuxConfDir, p.BaseOutputDir)); err != nil {
-			return err
-		}
+	if err := p.linuxUploadSecretKey(ctx, o, comm); err != nil {
+		return err
 	}
 
-	if err := p.postUploadDirectory(o, comm, linuxConfDir); err != nil {
+	return nil
+}
+
+func (p *provisioner) linuxUploadSecretKey(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	if p.SecretKey == "" {
+		return nil
+	}
+	o.Output("Uploading encrypted data bag secret")
+	// The secret is uploaded to a directory only the connecting user can
+	// access, then installed with its final mode, so it never lands on disk
+	// readable by anyone else
+	staging, err := p.createStagingDir(ctx, o, comm)
+	if err != nil {
 		return err
 	}
+	defer p.removeStagingDir(ctx, o, comm, staging)
 
+	staged := path.Join(staging, secretKey)
+	if err := comm.Upload(staged, strings.NewReader(p.SecretKey)); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", secretKey, err)
+	}
+	install := []string{"install", "-m", "600"}
+	if p.useSudo {
+		install = append(install, "-o", p.RemoteOwner, "-g", p.RemoteGroup)
+	}
+	install = append(install, staged, path.Join(p.DefaultConfDir, secretKey))
+	if err := p.runRemote(ctx, o, comm, shellJoin(install...)); err != nil {
+		return fmt.Errorf("installing %s failed: %v", secretKey, err)
+	}
 	return nil
 }
 
-func (p *provisioner) linuxInstallChefAsAService(o terraform.UIOutput, comm communicator.Communicator,
-	chefCmd string) error {
+// serviceName returns the systemd unit running chef-client at boot for the
+// bundle
+func (p *provisioner) serviceName() string {
+	return fmt.Sprintf(serviceUnit, p.BundleID)
+}
+
+func (p *provisioner) linuxInstallChefAsAService(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator, chefCmd string) error {
 
 	if !p.useSudo {
-		return fmt.Errorf("you need to use the option use_sudo to install chef as a service")
+		return fmt.Errorf("you need to use the option use_sudo or privilege_escalation to install chef as a service")
 	}
 	// evaluate tpl
 	// Create a new template and parse the client config into it
@@ -132,7 +304,8 @@ func (p *provisioner) linuxInstallChefAsAService(o terraform.UIOutput, comm comm
 		ChefCookbookDirectory string
 	}
 
-	chefStruct := ChefService{chefCmd, path.Join(linuxConfDir, p.BaseOutputDir)}
+	serviceName := p.serviceName()
+	chefStruct := ChefService{p.linuxServiceLocked(chefCmd), path.Join(p.DefaultConfDir, p.BaseOutputDir)}
 	t, _ := template.New(serviceName).Parse(chefService)
 
 	var buf bytes.Buffer
@@ -141,18 +314,22 @@ func (p *provisioner) linuxInstallChefAsAService(o terraform.UIOutput, comm comm
 		return fmt.Errorf("error executing %s template: %s", serviceName, err)
 	}
 
-	// Copy the client config to the new instance
-	var service = path.Join("/", "tmp", serviceName)
+	// Stage the unit in a private directory as remote_tmp_dir may be shared
+	staging, err := p.createStagingDir(ctx, o, comm)
+	if err != nil {
+		return err
+	}
+	defer p.removeStagingDir(ctx, o, comm, staging)
 
+	var service = path.Join(staging, serviceName)
 	if err = comm.Upload(service, &buf); err != nil {
 		return fmt.Errorf("uploading %s failed: %v", serviceName, err)
 	}
 
-	if err := p.runMultipleCommands(o, comm, []string{
-		fmt.Sprintf(chmod, service, 755),
-		fmt.Sprintf("mv %s %s", service, path.Join(servicePath, serviceName)),
+	if err := p.runMultipleCommands(ctx, o, comm, []string{
+		shellJoin("install", "-m", "644", "-o", "root", "-g", "root", service, path.Join(servicePath, serviceName)),
 		reloadDeamon,
-		fmt.Sprintf(enableService, serviceName),
+		fmt.Sprintf(enableService, shellQuote(serviceName)),
 	}); err != nil {
 		return err
 	}
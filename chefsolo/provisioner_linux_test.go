@@ -1,16 +1,48 @@
 package chefsolo
 
 import (
+	"context"
+	"io"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"fmt"
 	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/spf13/afero"
 )
 
+const testStagingDir = "/tmp/chefsolo.Zx81kq0aPL"
+
+// stagingCommandFunc accepts the given commands, and answers mktemp with a
+// staging directory named like testStagingDir
+func stagingCommandFunc(commands map[string]bool) func(*remote.Cmd) error {
+	return outputCommandFunc(commands, nil)
+}
+
+// outputCommandFunc works like stagingCommandFunc, also writing the given
+// outputs to the standard output of their command
+func outputCommandFunc(commands map[string]bool, outputs map[string]string) func(*remote.Cmd) error {
+	return func(cmd *remote.Cmd) error {
+		if !commands[cmd.Command] {
+			return fmt.Errorf("Command not found: %s", cmd.Command)
+		}
+		if strings.HasPrefix(cmd.Command, "mktemp -d ") {
+			dir := strings.TrimPrefix(cmd.Command, "mktemp -d ")
+			io.WriteString(cmd.Stdout, strings.Replace(dir, "XXXXXXXXXX", "Zx81kq0aPL", 1)+"\n")
+		}
+		if out, ok := outputs[cmd.Command]; ok {
+			io.WriteString(cmd.Stdout, out)
+		}
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+}
+
 /*
 	test pre upload directory :
 		- sudo
@@ -35,8 +67,7 @@ func TestResourceProvider_preUploadDirectory(t *testing.T) {
 			},
 
 			Commands: map[string]bool{
-				"sudo bash -c 'mkdir -p " + directory + "'":     true,
-				"sudo bash -c 'chmod -R 777 " + directory + "'": true,
+				"sudo bash -c 'mkdir -p " + directory + "'": true,
 			},
 		},
 
@@ -52,8 +83,7 @@ func TestResourceProvider_preUploadDirectory(t *testing.T) {
 			},
 
 			Commands: map[string]bool{
-				"mkdir -p " + directory + "":     true,
-				"chmod -R 777 " + directory + "": true,
+				"mkdir -p " + directory + "": true,
 			},
 		},
 	}
@@ -75,7 +105,7 @@ func TestResourceProvider_preUploadDirectory(t *testing.T) {
 		}
 		p.DefaultConfDir = linuxConfDir
 
-		if err = p.preUploadDirectory(o, c, directory); err != nil {
+		if err = p.preUploadDirectory(context.Background(), o, c, directory); err != nil {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
 	}
@@ -98,9 +128,10 @@ func TestResourceProvider_postUploadDirectory(t *testing.T) {
 			},
 
 			Commands: map[string]bool{
-				"sudo bash -c 'chmod -R 755 " + directory + "'":                                          true,
+				"sudo bash -c 'cp -R " + testStagingDir + "/. " + directory + "/'":                       true,
+				"sudo bash -c 'chown -R root:root " + directory + "'":                                    true,
+				"sudo bash -c 'chmod -R u=rwX,g=rX,o= " + directory + "'":                                true,
 				"sudo bash -c 'find " + directory + " -maxdepth 1 -type f -exec /bin/chmod -R 600 {} +'": true,
-				"sudo bash -c 'chown -R root.root " + directory + "'":                                    true,
 			},
 		},
 
@@ -136,7 +167,7 @@ func TestResourceProvider_postUploadDirectory(t *testing.T) {
 		}
 		p.DefaultConfDir = linuxConfDir
 
-		if err = p.postUploadDirectory(o, c, directory); err != nil {
+		if err = p.postUploadDirectory(context.Background(), o, c, testStagingDir, directory); err != nil {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
 	}
@@ -162,17 +193,51 @@ func TestResourceProvider_uploadConfigFiles(t *testing.T) {
 
 			Commands: map[string]bool{
 				"sudo bash -c 'mkdir -p " + linuxConfDir + "'":                                              true,
-				"sudo bash -c 'chmod -R 777 " + linuxConfDir + "'":                                          true,
-				"sudo bash -c 'chmod -R 755 " + linuxConfDir + "'":                                          true,
+				"mktemp -d /tmp/chefsolo.XXXXXXXXXX":                                                        true,
+				"sudo bash -c 'cp -R " + testStagingDir + "/. " + linuxConfDir + "/'":                       true,
+				"sudo bash -c 'chown -R root:root " + linuxConfDir + "'":                                    true,
+				"sudo bash -c 'chmod -R u=rwX,g=rX,o= " + linuxConfDir + "'":                                true,
 				"sudo bash -c 'find " + linuxConfDir + " -maxdepth 1 -type f -exec /bin/chmod -R 600 {} +'": true,
-				"sudo bash -c 'chown -R root.root " + linuxConfDir + "'":                                    true,
+				"rm -rf " + testStagingDir:                                                                  true,
 			},
 			Uploads: map[string]string{
-				path.Join(linuxConfDir, "client.rb"): defaultLinuxClientConf,
+				path.Join(testStagingDir, "client.rb"): defaultLinuxClientConf,
 			},
 			UploadDirs: map[string]string{
-				"/output":     linuxConfDir,
-				"/custom_dir": path.Join(linuxConfDir, "output"),
+				"/output":     testStagingDir,
+				"/custom_dir": path.Join(testStagingDir, "output"),
+			},
+		},
+
+		"CustomOwner": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"run_list":         []interface{}{"cookbook::recipe"},
+				"remote_tmp_dir":   "/var/tmp/",
+				"remote_owner":     "chef",
+				"remote_group":     "wheel",
+			},
+
+			Commands: map[string]bool{
+				"sudo bash -c 'mkdir -p " + linuxConfDir + "'":                                              true,
+				"mktemp -d /var/tmp/chefsolo.XXXXXXXXXX":                                                    true,
+				"sudo bash -c 'cp -R /var/tmp/chefsolo.Zx81kq0aPL/. " + linuxConfDir + "/'":                 true,
+				"sudo bash -c 'chown -R chef:wheel " + linuxConfDir + "'":                                   true,
+				"sudo bash -c 'chmod -R u=rwX,g=rX,o= " + linuxConfDir + "'":                                true,
+				"sudo bash -c 'find " + linuxConfDir + " -maxdepth 1 -type f -exec /bin/chmod -R 600 {} +'": true,
+				"rm -rf /var/tmp/chefsolo.Zx81kq0aPL":                                                       true,
+			},
+			Uploads: map[string]string{
+				"/var/tmp/chefsolo.Zx81kq0aPL/client.rb": defaultLinuxClientConf,
+			},
+			UploadDirs: map[string]string{
+				"/output":     "/var/tmp/chefsolo.Zx81kq0aPL",
+				"/custom_dir": "/var/tmp/chefsolo.Zx81kq0aPL/output",
 			},
 		},
 
@@ -187,8 +252,7 @@ func TestResourceProvider_uploadConfigFiles(t *testing.T) {
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
 			Commands: map[string]bool{
-				"mkdir -p " + linuxConfDir + "":     true,
-				"chmod -R 777 " + linuxConfDir + "": true,
+				"mkdir -p " + linuxConfDir + "": true,
 			},
 			Uploads: map[string]string{
 				path.Join(linuxConfDir, "client.rb"): defaultLinuxClientConf,
@@ -198,13 +262,44 @@ func TestResourceProvider_uploadConfigFiles(t *testing.T) {
 				"/custom_dir": path.Join(linuxConfDir, "output"),
 			},
 		},
+
+		"SecretKey": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"run_list":         []interface{}{"cookbook::recipe"},
+				"secret_key":       "s3cr3t",
+			},
+			Commands: map[string]bool{
+				"sudo bash -c 'mkdir -p " + linuxConfDir + "'":                                              true,
+				"mktemp -d /tmp/chefsolo.XXXXXXXXXX":                                                        true,
+				"sudo bash -c 'cp -R " + testStagingDir + "/. " + linuxConfDir + "/'":                       true,
+				"sudo bash -c 'chown -R root:root " + linuxConfDir + "'":                                    true,
+				"sudo bash -c 'chmod -R u=rwX,g=rX,o= " + linuxConfDir + "'":                                true,
+				"sudo bash -c 'find " + linuxConfDir + " -maxdepth 1 -type f -exec /bin/chmod -R 600 {} +'": true,
+				"sudo bash -c 'install -m 600 -o root -g root " + testStagingDir + "/encrypted_data_bag_secret " +
+					linuxConfDir + "/encrypted_data_bag_secret'": true,
+				"rm -rf " + testStagingDir: true,
+			},
+			Uploads: map[string]string{
+				path.Join(testStagingDir, "client.rb"): secretKeyLinuxClientConf,
+				path.Join(testStagingDir, secretKey):   "s3cr3t",
+			},
+			UploadDirs: map[string]string{
+				"/output": testStagingDir,
+			},
+		},
 	}
 
 	o := new(terraform.MockUIOutput)
 	c := new(communicator.MockCommunicator)
 
 	for k, tc := range cases {
-		c.Commands = tc.Commands
+		c.CommandFunc = stagingCommandFunc(tc.Commands)
 		c.Uploads = tc.Uploads
 		c.UploadDirs = tc.UploadDirs
 		os := afero.NewMemMapFs()
@@ -220,7 +315,7 @@ func TestResourceProvider_uploadConfigFiles(t *testing.T) {
 		p.DefaultConfDir = linuxConfDir
 		p.osUploadConfigFiles = p.linuxUploadConfigFiles
 
-		if err = p.osUploadConfigFiles(o, c); err != nil {
+		if err = p.osUploadConfigFiles(context.Background(), o, c); err != nil {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
 	}
@@ -249,16 +344,18 @@ func TestResourceProvider_installChefAsService(t *testing.T) {
 				"use_sudo":           true,
 				"run_list":           []interface{}{"cookbook::recipe"},
 				"install_as_service": true,
+				"bundle_id":          "app",
 			},
 
 			Commands: map[string]bool{
-				"sudo bash -c 'find /tmp/chef-run.service -maxdepth 1 -type f -exec /bin/chmod -R 755 {} +'": true,
-				"sudo bash -c 'mv /tmp/chef-run.service /etc/systemd/system/chef-run.service'":               true,
-				"sudo bash -c 'systemctl daemon-reload'":                                                     true,
-				"sudo bash -c 'systemctl enable chef-run.service'":                                           true,
+				"mktemp -d /tmp/chefsolo.XXXXXXXXXX": true,
+				"sudo bash -c 'install -m 644 -o root -g root " + testStagingDir + "/chef-run-app.service /etc/systemd/system/chef-run-app.service'": true,
+				"sudo bash -c 'systemctl daemon-reload'":               true,
+				"sudo bash -c 'systemctl enable chef-run-app.service'": true,
+				"rm -rf " + testStagingDir:                             true,
 			},
 			Uploads: map[string]string{
-				path.Join("/tmp", serviceName): defaultChefService,
+				path.Join(testStagingDir, "chef-run-app.service"): defaultChefService,
 			},
 			Error: false,
 		},
@@ -284,7 +381,7 @@ func TestResourceProvider_installChefAsService(t *testing.T) {
 	c := new(communicator.MockCommunicator)
 
 	for k, tc := range cases {
-		c.Commands = tc.Commands
+		c.CommandFunc = stagingCommandFunc(tc.Commands)
 		c.Uploads = tc.Uploads
 		os := afero.NewMemMapFs()
 		os.MkdirAll("/input", 766)
@@ -299,22 +396,26 @@ func TestResourceProvider_installChefAsService(t *testing.T) {
 		p.DefaultConfDir = linuxConfDir
 		p.osUploadConfigFiles = p.linuxUploadConfigFiles
 
-		cmd := fmt.Sprintf(`%s -z -c %s -j %q -E %q`,
+		cmd := fmt.Sprintf(`%s -z -c %s -j %s -E %s`,
 			linuxChefCmd,
 			path.Join(linuxConfDir, clienrb),
 			path.Join(linuxConfDir, "output", "dna", "toto.json"),
 			defaultEnv)
 
-		if err = p.linuxInstallChefAsAService(o, c, cmd); err != nil && !tc.Error {
+		if err = p.linuxInstallChefAsAService(context.Background(), o, c, cmd); err != nil && !tc.Error {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
 	}
 }
 
 func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
+	script := testStagingDir + "/install.sh"
+	curl := "curl -fsSL -o " + script + " https://omnitruck.chef.io/install.sh"
 	cases := map[string]struct {
 		Config   map[string]interface{}
+		Tools    string
 		Commands map[string]bool
+		Error    bool
 	}{
 		"Sudo": {
 			Config: map[string]interface{}{
@@ -326,11 +427,10 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"use_sudo":         true,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
-
+			Tools: "/usr/bin/curl\n/usr/bin/wget\n",
 			Commands: map[string]bool{
-				"sudo bash -c 'curl -LO https://omnitruck.chef.io/install.sh'": true,
-				"sudo bash -c 'bash ./install.sh -v \"\" -c stable'":           true,
-				"sudo bash -c 'rm -f install.sh'":                              true,
+				curl: true,
+				"sudo bash -c 'bash " + script + ` -v '\'''\'' -c stable'`: true,
 			},
 		},
 
@@ -344,17 +444,32 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"use_sudo":         false,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
+			Tools: "/usr/bin/curl\n",
+			Commands: map[string]bool{
+				curl:                                  true,
+				"bash " + script + " -v '' -c stable": true,
+			},
+		},
 
+		"Wget": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         false,
+				"run_list":         []interface{}{"cookbook::recipe"},
+			},
+			Tools: "/usr/bin/wget\n",
 			Commands: map[string]bool{
-				"curl -LO https://omnitruck.chef.io/install.sh": true,
-				"bash ./install.sh -v \"\" -c stable":           true,
-				"rm -f install.sh":                              true,
+				"wget -q -O " + script + " https://omnitruck.chef.io/install.sh": true,
+				"bash " + script + " -v '' -c stable":                            true,
 			},
 		},
 
-		"HTTPProxy": {
+		"NoDownloadTool": {
 			Config: map[string]interface{}{
-				"http_proxy":       "http://proxy.local",
 				"instance_id":      `toto`,
 				"chef_module_path": `/input`,
 				"output_dir":       `/output`,
@@ -363,11 +478,26 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"use_sudo":         false,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
+			Tools:    "",
+			Commands: map[string]bool{},
+			Error:    true,
+		},
 
+		"HTTPProxy": {
+			Config: map[string]interface{}{
+				"http_proxy":       "http://proxy.local",
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         true,
+				"run_list":         []interface{}{"cookbook::recipe"},
+			},
+			Tools: "/usr/bin/curl\n",
 			Commands: map[string]bool{
-				"http_proxy='http://proxy.local' curl -LO https://omnitruck.chef.io/install.sh": true,
-				"http_proxy='http://proxy.local' bash ./install.sh -v \"\" -c stable":           true,
-				"http_proxy='http://proxy.local' rm -f install.sh":                              true,
+				"http_proxy=http://proxy.local " + curl:                                                  true,
+				"sudo bash -c 'http_proxy=http://proxy.local bash " + script + ` -v '\'''\'' -c stable'`: true,
 			},
 		},
 
@@ -382,11 +512,10 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"use_sudo":         false,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
-
+			Tools: "/usr/bin/curl\n",
 			Commands: map[string]bool{
-				"https_proxy='https://proxy.local' curl -LO https://omnitruck.chef.io/install.sh": true,
-				"https_proxy='https://proxy.local' bash ./install.sh -v \"\" -c stable":           true,
-				"https_proxy='https://proxy.local' rm -f install.sh":                              true,
+				"https_proxy=https://proxy.local " + curl:                             true,
+				"https_proxy=https://proxy.local bash " + script + " -v '' -c stable": true,
 			},
 		},
 
@@ -402,14 +531,11 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"use_sudo":         false,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
-
+			Tools: "/usr/bin/curl\n",
 			Commands: map[string]bool{
-				"http_proxy='http://proxy.local' no_proxy='http://local.local,http://local.org' " +
-					"curl -LO https://omnitruck.chef.io/install.sh": true,
-				"http_proxy='http://proxy.local' no_proxy='http://local.local,http://local.org' " +
-					"bash ./install.sh -v \"\" -c stable": true,
-				"http_proxy='http://proxy.local' no_proxy='http://local.local,http://local.org' " +
-					"rm -f install.sh": true,
+				"http_proxy=http://proxy.local no_proxy=http://local.local,http://local.org " + curl: true,
+				"http_proxy=http://proxy.local no_proxy=http://local.local,http://local.org " +
+					"bash " + script + " -v '' -c stable": true,
 			},
 		},
 
@@ -424,11 +550,29 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 				"run_list":         []interface{}{"cookbook::recipe"},
 				"version":          "11.18.6",
 			},
+			Tools: "/usr/bin/curl\n",
+			Commands: map[string]bool{
+				curl: true,
+				"bash " + script + " -v 11.18.6 -c stable": true,
+			},
+		},
 
+		"Checksum": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/input`,
+				"output_dir":       `/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+				"use_sudo":         false,
+				"run_list":         []interface{}{"cookbook::recipe"},
+				"installer_sha256": testSum("install.sh"),
+			},
+			Tools: "/usr/bin/curl\n",
 			Commands: map[string]bool{
-				"curl -LO https://omnitruck.chef.io/install.sh": true,
-				"bash ./install.sh -v \"11.18.6\" -c stable":    true,
-				"rm -f install.sh":                              true,
+				curl: true,
+				"echo '" + testSum("install.sh") + "  " + script + "' | sha256sum -c -": true,
+				"bash " + script + " -v '' -c stable":                                   true,
 			},
 		},
 	}
@@ -437,7 +581,11 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 	c := new(communicator.MockCommunicator)
 
 	for k, tc := range cases {
-		c.Commands = tc.Commands
+		// Every case stages the installer and looks for a download tool
+		tc.Commands["mktemp -d /tmp/chefsolo.XXXXXXXXXX"] = true
+		tc.Commands["command -v curl wget || true"] = true
+		tc.Commands["rm -rf "+testStagingDir] = true
+		c.CommandFunc = outputCommandFunc(tc.Commands, map[string]string{"command -v curl wget || true": tc.Tools})
 
 		os := afero.NewMemMapFs()
 		os.MkdirAll("/input", 766)
@@ -450,10 +598,90 @@ func TestResourceProvider_linuxInstallChefClient(t *testing.T) {
 			t.Fatalf("Error: %v", err)
 		}
 
-		err = p.linuxInstallChefClient(o, c)
-		if err != nil {
+		err = p.linuxInstallChefClient(context.Background(), o, c)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+	}
+}
+
+func TestResourceProvider_linuxInstallChefClientRetries(t *testing.T) {
+	defer func(interval time.Duration) { installRetryInterval = interval }(installRetryInterval)
+	installRetryInterval = time.Millisecond
+
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for k, failures := range map[string]int{"recovers": installAttempts - 1, "gives up": installAttempts} {
+		attempts := 0
+		removed := false
+		c := new(communicator.MockCommunicator)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			switch {
+			case strings.HasPrefix(cmd.Command, "mktemp -d "):
+				io.WriteString(cmd.Stdout, testStagingDir+"\n")
+			case strings.HasPrefix(cmd.Command, "command -v "):
+				io.WriteString(cmd.Stdout, "/usr/bin/curl\n")
+			case strings.HasPrefix(cmd.Command, "curl "):
+				if attempts++; attempts <= failures {
+					cmd.SetExitStatus(22, nil)
+					return nil
+				}
+			case cmd.Command == "rm -rf "+testStagingDir:
+				removed = true
+			}
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		err := p.linuxInstallChefClient(context.Background(), new(terraform.MockUIOutput), c)
+		if (err != nil) != (failures == installAttempts) {
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
+		if attempts != installAttempts {
+			t.Fatalf("Test %q failed: expected %d attempts, got %d", k, installAttempts, attempts)
+		}
+		if !removed {
+			t.Fatalf("Test %q failed: the staging directory was not removed", k)
+		}
+	}
+
+	// An interrupted apply stops retrying at once
+	installRetryInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	c := new(communicator.MockCommunicator)
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		switch {
+		case strings.HasPrefix(cmd.Command, "mktemp -d "):
+			io.WriteString(cmd.Stdout, testStagingDir+"\n")
+		case strings.HasPrefix(cmd.Command, "command -v "):
+			io.WriteString(cmd.Stdout, "/usr/bin/curl\n")
+		case strings.HasPrefix(cmd.Command, "curl "):
+			attempts++
+			cmd.SetExitStatus(22, nil)
+			return nil
+		}
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+	if err := p.runWithRetries(ctx, new(terraform.MockUIOutput), c, "curl -fsSL -o /tmp/install.sh https://omnitruck"); err == nil || attempts != 1 {
+		t.Fatalf("expected the interrupted apply to give up after 1 attempt, got %d attempts and %v", attempts, err)
 	}
 }
 
@@ -467,22 +695,35 @@ cookbook_path '/opt/chef/0/output/cookbooks'
 node_path '/opt/chef/0/output/nodes'
 role_path '/opt/chef/0/output/roles'
 data_bag_path '/opt/chef/0/output/data_bags'
-rubygems_url 'http://nexus.query.consul/content/groups/rubygems'
+environment_path '/opt/chef/0/output/environments'`
+
+const secretKeyLinuxClientConf = `log_location            STDOUT
+
+
+local_mode true
+encrypted_data_bag_secret '/opt/chef/0/encrypted_data_bag_secret'
+
+cookbook_path '/opt/chef/0/output/cookbooks'
+
+node_path '/opt/chef/0/output/nodes'
+role_path '/opt/chef/0/output/roles'
+data_bag_path '/opt/chef/0/output/data_bags'
 environment_path '/opt/chef/0/output/environments'`
 
 const defaultChefService = `
 [Unit]
 Description=Run chef client each time the machine reboot
-After = network.target auditd.service
+After=network.target auditd.service
 
 [Service]
-Type=simple
+Type=oneshot
 WorkingDirectory=/opt/chef/0/output
-ExecStart=/usr/bin/chef-client -z -c /opt/chef/0/client.rb -j "/opt/chef/0/output/dna/toto.json" -E "_default"
-ExecReload = /bin/kill -HUP $MAINPID
-SuccessExitStatus = 3
-Restart = on-failure
+ExecStart=/usr/bin/flock -w 1800 /var/lock/chef-client.lock /usr/bin/chef-client -z -c /opt/chef/0/client.rb -j /opt/chef/0/output/dna/toto.json -E _default
+SuccessExitStatus=3
+Restart=on-failure
+RestartSec=60
+RemainAfterExit=true
 
 [Install]
-WantedBy = multi-user.target
+WantedBy=multi-user.target
 `
@@ -1,19 +1,28 @@
 package chefsolo
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/terraform/communicator"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
 	"github.com/theckman/go-flock"
-	"os"
+	"log"
 	"path"
 	"path/filepath"
 	"time"
 )
 
+const (
+	bundleLockFile        = "chefsolo.lock"
+	bundleDoneFile        = "bundle-done"
+	bundleFailedFile      = "bundle-failed"
+	maxBundlePollInterval = 10 * time.Second
+)
+
 func (p *provisioner) prepareConfigFiles(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator, confDir string) error {
 	if err := p.renderChefData(ctx, o); err != nil {
 		return err
@@ -21,31 +30,15 @@ func (p *provisioner) prepareConfigFiles(ctx context.Context, o terraform.UIOutp
 	return nil
 }
 
+// renderChefData bundles the cookbooks and node files once per workspace, the
+// instances joining a workspace which is already bundled only add their dna
 func (p *provisioner) renderChefData(ctx context.Context, o terraform.UIOutput) error {
-	fileLock := flock.NewFlock(path.Join(p.OutputDir, "chefsolo.lock"))
-	if locked, err := fileLock.TryLock(); err == nil && locked {
-		if err := p.bundleChef(ctx, o); err != nil {
-			fileLock.Unlock()
-			return err
-		}
-		if _, err := p.buildNodeFiles(o); err != nil {
-			fileLock.Unlock()
-			return err
-		}
-
-		p.os.Create(path.Join(p.OutputDir, "bundle-done"))
-		fileLock.Unlock()
-	} else {
-		_, err := p.os.Stat(path.Join(p.OutputDir, "bundle-done"))
-		ttw := 2 * time.Second
-		for (os.IsNotExist(err) || err != nil) && ttw < 40*time.Second {
-			time.Sleep(ttw)
-			ttw *= 2
-			_, err = p.os.Stat(path.Join(p.OutputDir, "bundle-done"))
-		}
-		if os.IsNotExist(err) {
-			return fmt.Errorf("bundle seems stuck, stopping it")
-		}
+	done, err := p.bundleEnded()
+	if !done {
+		err = p.bundleOnce(ctx, o)
+	}
+	if err != nil {
+		return err
 	}
 
 	o.Output("Bundling dna file " + p.InstanceId)
@@ -55,23 +48,113 @@ func (p *provisioner) renderChefData(ctx context.Context, o terraform.UIOutput)
 	return nil
 }
 
-func (p *provisioner) getBundleCommand() []string {
+// bundleOnce bundles the workspace with its lock held, or waits for the
+// instance holding it
+func (p *provisioner) bundleOnce(ctx context.Context, o terraform.UIOutput) error {
+	fileLock := flock.NewFlock(path.Join(p.OutputDir, bundleLockFile))
+	if locked, err := fileLock.TryLock(); err != nil || !locked {
+		return p.waitForBundle(ctx, o)
+	}
+	defer fileLock.Unlock()
+
+	// The bundle may have ended between the first check and the lock
+	if done, err := p.bundleEnded(); done {
+		return err
+	}
+	err := p.bundleChef(ctx, o)
+	if err == nil {
+		_, err = p.buildNodeFiles(o)
+	}
+	if err != nil {
+		// Let the instances waiting for this bundle fail with the real error
+		p.markBundle(bundleFailedFile, err.Error())
+		return err
+	}
+	p.markBundle(bundleDoneFile, "")
+	return nil
+}
+
+// bundleEnded tells whether the bundle of the workspace is done, returning
+// the error of the instance which failed it
+func (p *provisioner) bundleEnded() (bool, error) {
+	if _, err := p.os.Stat(path.Join(p.OutputDir, bundleDoneFile)); err == nil {
+		return true, nil
+	}
+	if failure, err := afero.ReadFile(p.os, path.Join(p.OutputDir, bundleFailedFile)); err == nil {
+		return true, fmt.Errorf("bundle failed in another instance: %s", failure)
+	}
+	return false, nil
+}
+
+// markBundle atomically writes a marker telling the waiting instances how
+// the bundle ended
+func (p *provisioner) markBundle(marker string, content string) {
+	markerPath := path.Join(p.OutputDir, marker)
+	if err := afero.WriteFile(p.os, markerPath+".tmp", []byte(content), 0644); err != nil {
+		log.Printf("Error writing bundle marker %s: %v", markerPath, err)
+		return
+	}
+	if err := p.os.Rename(markerPath+".tmp", markerPath); err != nil {
+		log.Printf("Error writing bundle marker %s: %v", markerPath, err)
+	}
+}
+
+// waitForBundle waits for the instance holding the bundle lock to be done,
+// failing as soon as it reports an error
+func (p *provisioner) waitForBundle(ctx context.Context, o terraform.UIOutput) error {
+	start := time.Now()
+	interval := time.Second
+	for {
+		if done, err := p.bundleEnded(); done || err != nil {
+			return err
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= p.BundleWaitTimeout {
+			return fmt.Errorf("timed out after %s waiting for another instance to bundle the cookbooks", p.BundleWaitTimeout)
+		}
+		o.Output(fmt.Sprintf("Waiting for another instance to bundle the cookbooks (%s elapsed)",
+			elapsed.Round(time.Second)))
+
+		if remaining := p.BundleWaitTimeout - elapsed; interval > remaining {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxBundlePollInterval {
+			interval = maxBundlePollInterval
+		}
+	}
+}
+
+// getBundleCommand returns the commands vendoring the cookbooks into outputDir
+func (p *provisioner) getBundleCommand(outputDir string) []string {
 	chefPath, _ := homedir.Expand(p.ChefModulePath)
 	prefix := "bundle exec"
 	commands := []string{
-		fmt.Sprintf("%s berks vendor -b=\"%s/Berksfile\" %s", prefix, chefPath, p.OutputDir),
+		fmt.Sprintf("%s berks vendor -b=\"%s/Berksfile\" %s", prefix, chefPath, outputDir),
 	}
 	if p.UsePolicyfile {
 		commands = []string{
 			fmt.Sprintf("%s chef install %s/Policyfile.rb", prefix, chefPath),
-			fmt.Sprintf("%s chef export --force %s/Policyfile.rb %s", prefix, chefPath, p.OutputDir),
+			fmt.Sprintf("%s chef export --force %s/Policyfile.rb %s", prefix, chefPath, outputDir),
 		}
 	}
 	return commands
 }
 
 func (p *provisioner) bundleChef(ctx context.Context, o terraform.UIOutput) error {
-	for _, comm := range p.getBundleCommand() {
+	if p.BundleCache {
+		return p.bundleChefCached(ctx, o)
+	}
+	return p.runBundleCommand(ctx, o, p.OutputDir)
+}
+
+func (p *provisioner) runBundleCommand(ctx context.Context, o terraform.UIOutput, outputDir string) error {
+	for _, comm := range p.getBundleCommand(outputDir) {
 		if err := p.runLocal(ctx, o, comm); err != nil {
 			return err
 		}
@@ -101,12 +184,12 @@ func (p *provisioner) buildNodeFiles(o terraform.UIOutput) (*flock.Flock, error)
 	lockedNode, err := lock.TryLock()
 	if lockedNode && err == nil {
 		for _, node := range p.Nodes {
-			tmp := make(map[string]interface{})
-			if err := json.Unmarshal([]byte(node.(string)), &tmp); err != nil {
+			id, err := nodeID(node.(string))
+			if err != nil {
 				lock.Unlock()
-				return lock, fmt.Errorf("error unable to render json %s: %v", node, err)
+				return lock, err
 			}
-			if err := p.bumpFile(path.Join(p.OutputDir, "nodes", tmp["id"].(string)+".json"), node.(string), o); err != nil {
+			if err := p.bumpFile(path.Join(p.OutputDir, "nodes", id+".json"), node.(string), o); err != nil {
 				lock.Unlock()
 				return lock, err
 			}
@@ -115,29 +198,50 @@ func (p *provisioner) buildNodeFiles(o terraform.UIOutput) (*flock.Flock, error)
 	return lock, nil
 }
 
+// bumpFile writes data, as canonical json, to filePath unless the file already
+// holds the same document. The file is written to a temporary file renamed
+// into place so readers never see it half written.
 func (p *provisioner) bumpFile(filePath string, data string, o terraform.UIOutput) error {
 	nodePath, err := homedir.Expand(filePath)
-	o.Output("Looking for " + nodePath + " existence")
-	if _, err = p.os.Stat(nodePath); err == nil {
-		o.Output("File already exist, not building it again")
-		return nil
+	if err != nil {
+		return fmt.Errorf("error expanding %s: %v", filePath, err)
 	}
-
-	f, err := p.os.Create(path.Join(nodePath))
+	content, err := canonicalJSON([]byte(data))
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %v", nodePath, err)
+		return fmt.Errorf("error unable to render json %s: %v", data, err)
 	}
 
-	o.Output("Writing " + nodePath)
-	_, err = f.Write([]byte(data))
-	o.Output("File written " + nodePath)
+	state := "created"
+	if existing, err := afero.ReadFile(p.os, nodePath); err == nil {
+		if current, err := canonicalJSON(existing); err == nil && bytes.Equal(current, content) {
+			o.Output(nodePath + ": unchanged")
+			return nil
+		}
+		state = "updated"
+	}
 
+	f, err := afero.TempFile(p.os, filepath.Dir(nodePath), "."+filepath.Base(nodePath)+".tmp-")
 	if err != nil {
+		return fmt.Errorf("error creating file %s: %v", nodePath, err)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		p.os.Remove(f.Name())
 		return fmt.Errorf("failed to write data %s to node file %s: %v", data, nodePath, err)
 	}
-
 	if err := f.Close(); err != nil {
+		p.os.Remove(f.Name())
 		return fmt.Errorf("error closing node file %s: %v", nodePath, err)
 	}
+	if err := p.os.Chmod(f.Name(), 0644); err != nil {
+		p.os.Remove(f.Name())
+		return fmt.Errorf("error setting permissions of node file %s: %v", nodePath, err)
+	}
+	if err := p.os.Rename(f.Name(), nodePath); err != nil {
+		p.os.Remove(f.Name())
+		return fmt.Errorf("error moving node file %s into place: %v", nodePath, err)
+	}
+
+	o.Output(nodePath + ": " + state)
 	return nil
 }
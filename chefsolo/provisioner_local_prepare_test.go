@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strings"
 )
 
 func TestResourceProvider_buildNodeFiles(t *testing.T) {
@@ -150,11 +151,27 @@ func TestResourceProvider_renderChefData(t *testing.T) {
 	cases := map[string]struct {
 		Config        map[string]interface{}
 		BundleEnd     bool
+		BundleFailure string
 		Locked        bool
-		Error         bool
+		Error         string
 		FilesProduced []string
 	}{
 		"lock exist and bundle does not end": {
+			Config: map[string]interface{}{
+				"instance_id":         `toto`,
+				"chef_module_path":    `/tmp/tf/input`,
+				"output_dir":          `/tmp/tf/output`,
+				"nodes":               []string{`{ "id":"toto"}`},
+				"target_node":         `{ "id":"toto"}`,
+				"use_sudo":            true,
+				"run_list":            []interface{}{"cookbook::recipe"},
+				"bundle_wait_timeout": "2s",
+			},
+			Locked:    true,
+			BundleEnd: false,
+			Error:     "timed out after 2s",
+		},
+		"lock exist and bundle failed": {
 			Config: map[string]interface{}{
 				"instance_id":      `toto`,
 				"chef_module_path": `/tmp/tf/input`,
@@ -164,9 +181,9 @@ func TestResourceProvider_renderChefData(t *testing.T) {
 				"use_sudo":         true,
 				"run_list":         []interface{}{"cookbook::recipe"},
 			},
-			Locked:    true,
-			BundleEnd: false,
-			Error:     true,
+			Locked:        true,
+			BundleFailure: "Berksfile: unknown cookbook 'tpyo'",
+			Error:         "bundle failed in another instance: Berksfile: unknown cookbook 'tpyo'",
 		},
 		"lock exist and bundle does end": {
 			Config: map[string]interface{}{
@@ -180,7 +197,29 @@ func TestResourceProvider_renderChefData(t *testing.T) {
 			},
 			Locked:    true,
 			BundleEnd: true,
-			Error:     false,
+		},
+		// The bundle commands would fail here, an instance joining a bundled
+		// workspace must not run them again
+		"bundle ended without lock": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/tmp/tf/input`,
+				"output_dir":       `/tmp/tf/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			BundleEnd: true,
+		},
+		"bundle failed without lock": {
+			Config: map[string]interface{}{
+				"instance_id":      `toto`,
+				"chef_module_path": `/tmp/tf/input`,
+				"output_dir":       `/tmp/tf/output`,
+				"nodes":            []string{`{ "id":"toto"}`},
+				"target_node":      `{ "id":"toto"}`,
+			},
+			BundleFailure: "Berksfile: unknown cookbook 'tpyo'",
+			Error:         "bundle failed in another instance: Berksfile: unknown cookbook 'tpyo'",
 		},
 	}
 
@@ -204,9 +243,12 @@ func TestResourceProvider_renderChefData(t *testing.T) {
 		if tc.BundleEnd {
 			os.Create(path.Join("/tmp/tf", "output", "bundle-done"))
 		}
+		if tc.BundleFailure != "" {
+			afero.WriteFile(os, path.Join("/tmp/tf", "output", "bundle-failed"), []byte(tc.BundleFailure), 0644)
+		}
 		err = p.renderChefData(context.Background(), o)
 
-		if (tc.Error == false && err != nil) || (tc.Error == true && err == nil) {
+		if (tc.Error == "" && err != nil) || (tc.Error != "" && (err == nil || !strings.Contains(err.Error(), tc.Error))) {
 			os.RemoveAll("/tmp/tf")
 			t.Fatalf("Test %q failed: %v", k, err)
 		}
@@ -214,6 +256,142 @@ func TestResourceProvider_renderChefData(t *testing.T) {
 	}
 }
 
+func TestResourceProvider_renderChefDataFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-test")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs := afero.NewOsFs()
+	defer fs.RemoveAll(dir)
+	fs.MkdirAll(filepath.Join(dir, "input"), 0777)
+
+	config := map[string]interface{}{
+		"instance_id":         `toto`,
+		"chef_module_path":    filepath.Join(dir, "input"),
+		"output_dir":          filepath.Join(dir, "output"),
+		"nodes":               []string{`{ "id":"toto"}`},
+		"target_node":         `{ "id":"toto"}`,
+		"bundle_cache":        false,
+		"bundle_wait_timeout": "2s",
+	}
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// There is no Berksfile in the module path, so bundling fails
+	err = p.renderChefData(context.Background(), new(terraform.MockUIOutput))
+	if err == nil {
+		t.Fatalf("expected the bundle to fail")
+	}
+
+	failure, readErr := afero.ReadFile(fs, filepath.Join(dir, "output", "bundle-failed"))
+	if readErr != nil {
+		t.Fatalf("expected a failure marker: %v", readErr)
+	}
+	if string(failure) != err.Error() {
+		t.Fatalf("expected the failure marker to contain %q, got %q", err.Error(), failure)
+	}
+	if _, err := fs.Stat(filepath.Join(dir, "output", "bundle-done")); err == nil {
+		t.Fatalf("a failed bundle must not be marked as done")
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	cases := map[string]struct {
+		Data     string
+		Expected string
+		Error    bool
+	}{
+		"Sorted keys": {
+			Data:     `{"run_list":["recipe[app]"],"id":"toto","a":{"z":1,"b":2}}`,
+			Expected: "{\n  \"a\": {\n    \"b\": 2,\n    \"z\": 1\n  },\n  \"id\": \"toto\",\n  \"run_list\": [\n    \"recipe[app]\"\n  ]\n}\n",
+		},
+		"Numbers and html kept as is": {
+			Data:     `{ "big": 12345678901234567890, "float": 1.50, "html": "<a&b>" }`,
+			Expected: "{\n  \"big\": 12345678901234567890,\n  \"float\": 1.50,\n  \"html\": \"<a&b>\"\n}\n",
+		},
+		"Invalid": {
+			Data:  `{ "id": `,
+			Error: true,
+		},
+		"Trailing data": {
+			Data:  `{ "id": "toto" } { "id": "titi" }`,
+			Error: true,
+		},
+	}
+
+	for k, tc := range cases {
+		out, err := canonicalJSON([]byte(tc.Data))
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if string(out) != tc.Expected {
+			t.Fatalf("Test %q failed: expected %q, got %q", k, tc.Expected, out)
+		}
+	}
+}
+
+func TestResourceProvider_bumpFile(t *testing.T) {
+	cases := map[string]struct {
+		Existing string
+		Data     string
+		Output   string
+		Content  string
+	}{
+		"Created": {
+			Data:    `{"id":"toto"}`,
+			Output:  "/output/nodes/toto.json: created",
+			Content: "{\n  \"id\": \"toto\"\n}\n",
+		},
+		"Unchanged": {
+			Existing: `{ "id": "toto",   "run_list": [] }`,
+			Data:     `{"run_list":[],"id":"toto"}`,
+			Output:   "/output/nodes/toto.json: unchanged",
+			Content:  `{ "id": "toto",   "run_list": [] }`,
+		},
+		"Updated": {
+			Existing: `{"id":"toto"}`,
+			Data:     `{"id":"toto","run_list":["recipe[app]"]}`,
+			Output:   "/output/nodes/toto.json: updated",
+			Content:  "{\n  \"id\": \"toto\",\n  \"run_list\": [\n    \"recipe[app]\"\n  ]\n}\n",
+		},
+		"Existing file is not json": {
+			Existing: `garbage`,
+			Data:     `{"id":"toto"}`,
+			Output:   "/output/nodes/toto.json: updated",
+			Content:  "{\n  \"id\": \"toto\"\n}\n",
+		},
+	}
+
+	for k, tc := range cases {
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/output/nodes", 0766)
+		if tc.Existing != "" {
+			afero.WriteFile(fs, "/output/nodes/toto.json", []byte(tc.Existing), 0644)
+		}
+		p := &provisioner{os: fs}
+		o := new(terraform.MockUIOutput)
+
+		if err := p.bumpFile("/output/nodes/toto.json", tc.Data, o); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if o.OutputMessage != tc.Output {
+			t.Fatalf("Test %q failed: expected %q, got %q", k, tc.Output, o.OutputMessage)
+		}
+		content, err := afero.ReadFile(fs, "/output/nodes/toto.json")
+		if err != nil || string(content) != tc.Content {
+			t.Fatalf("Test %q failed: expected %q, got %q: %v", k, tc.Content, content, err)
+		}
+		files, _ := afero.ReadDir(fs, "/output/nodes")
+		if len(files) != 1 {
+			t.Fatalf("Test %q failed: expected the temporary file to be gone, got %d files", k, len(files))
+		}
+	}
+}
+
 func contains(slice []string, item string) bool {
 	set := make(map[string]struct{}, len(slice))
 	for _, s := range slice {
@@ -0,0 +1,108 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	linuxLockFile   = "/var/lock/chef-client.lock"
+	windowsLockFile = "C:/ProgramData/chef-client.lock"
+	lockScript      = "chef-client-locked.ps1"
+	// linuxLockCmd takes the lock on a descriptor chef-client inherits, so it
+	// is held for the whole run and released whenever chef-client exits
+	linuxLockCmd = `exec 9>> %[1]s; ` +
+		`if ! flock -n 9; then ` +
+		`echo "Waiting up to %[2]s for the chef-client lock %[1]s, held by:"; %[3]s; ` +
+		`flock -w %[4]d 9 || { echo "Timed out after %[2]s waiting for the chef-client lock %[1]s, held by:"; %[3]s; exit 1; }; ` +
+		`fi; `
+	linuxLockHolders = `lslocks -n -o PID,PATH 2> /dev/null | ` +
+		`while read pid file; do [ "$file" = %s ] && ps -o pid=,args= -p "$pid"; done`
+	windowsLockWrapper = `$lockFile = %s
+$deadline = (Get-Date).AddSeconds(%d)
+$lock = $null
+while ($lock -eq $null) {
+  try {
+    # Others may read who holds the lock, but not take it
+    $lock = [IO.File]::Open($lockFile, 'OpenOrCreate', 'ReadWrite', 'Read')
+  } catch [IO.IOException] {
+    $holder = Get-Content -Path $lockFile -ErrorAction SilentlyContinue
+    if ((Get-Date) -gt $deadline) {
+      Write-Output "Timed out after %s waiting for the chef-client lock $lockFile, held by: $holder"
+      exit 1
+    }
+    Write-Output "Waiting up to %s for the chef-client lock $lockFile, held by: $holder"
+    Start-Sleep -Seconds 10
+  }
+}
+$lock.SetLength(0)
+$writer = New-Object IO.StreamWriter($lock)
+$writer.WriteLine("pid $PID, bundle %s, since $(Get-Date -Format o)")
+$writer.Flush()
+try {
+  & cmd /c %s
+  $code = $LASTEXITCODE
+} finally {
+  $lock.Close()
+}
+exit $code
+`
+)
+
+// lockFile returns the lock serializing the chef-client runs of the machine
+func (p *provisioner) lockFile() string {
+	if p.RemoteLockFile != "" {
+		return p.RemoteLockFile
+	}
+	if p.OSType == "windows" {
+		return windowsLockFile
+	}
+	return linuxLockFile
+}
+
+// linuxLocked prefixes a shell command with the acquisition of the remote
+// lock, printing the processes holding it while waiting
+func (p *provisioner) linuxLocked(command string) string {
+	lock := shellQuote(p.lockFile())
+	return fmt.Sprintf(linuxLockCmd, lock, p.LockTimeout, fmt.Sprintf(linuxLockHolders, lock),
+		int(p.LockTimeout/time.Second)) + command
+}
+
+// linuxServiceLocked wraps the command of the chef-run-<bundle_id>.service
+// unit, which is not run by a shell, with the remote lock
+func (p *provisioner) linuxServiceLocked(command string) string {
+	return fmt.Sprintf("/usr/bin/flock -w %d %s %s", int(p.LockTimeout/time.Second), p.lockFile(), command)
+}
+
+// windowsLocked uploads a script running the command under the remote lock,
+// and returns the command running the script
+func (p *provisioner) windowsLocked(comm communicator.Communicator, command string) (string, error) {
+	script := path.Join(p.DefaultConfDir, lockScript)
+	content := fmt.Sprintf(windowsLockWrapper, powershellQuote(p.lockFile()), int(p.LockTimeout/time.Second),
+		p.LockTimeout, p.LockTimeout, p.BundleID, powershellQuote(command))
+	if err := comm.Upload(script, strings.NewReader(content)); err != nil {
+		return "", fmt.Errorf("uploading %s failed: %v", lockScript, err)
+	}
+	return fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File %s", cmdQuote(script)), nil
+}
+
+// runLocked runs chef-client under the remote lock, so the runs of this
+// provisioner, of other workspaces and of the chef-run-<bundle_id>.service
+// units never overlap on the machine
+func (p *provisioner) runLocked(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	if p.OSType == "windows" {
+		locked, err := p.windowsLocked(comm, command)
+		if err != nil {
+			return err
+		}
+		return p.runChefPasses(ctx, o, comm, locked)
+	}
+	return p.runChefPasses(ctx, o, comm, p.linuxLocked(command))
+}
@@ -0,0 +1,107 @@
+package chefsolo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+// testLockPrefix takes the default remote lock ahead of chef-client
+const testLockPrefix = `exec 9>> /var/lock/chef-client.lock; if ! flock -n 9; then ` +
+	`echo "Waiting up to 30m0s for the chef-client lock /var/lock/chef-client.lock, held by:"; ` +
+	`lslocks -n -o PID,PATH 2> /dev/null | while read pid file; do [ "$file" = /var/lock/chef-client.lock ] && ps -o pid=,args= -p "$pid"; done; ` +
+	`flock -w 1800 9 || { echo "Timed out after 30m0s waiting for the chef-client lock /var/lock/chef-client.lock, held by:"; ` +
+	`lslocks -n -o PID,PATH 2> /dev/null | while read pid file; do [ "$file" = /var/lock/chef-client.lock ] && ps -o pid=,args= -p "$pid"; done; exit 1; }; fi; `
+
+func TestResourceProvider_runLocked(t *testing.T) {
+	cases := map[string]struct {
+		Config     map[string]interface{}
+		Connection string
+		Command    string
+		Uploads    map[string]string
+	}{
+		"Linux": {
+			Config: map[string]interface{}{
+				"remote_lock_file": "/run/chef lock",
+				"lock_timeout":     "90s",
+			},
+			Connection: "ssh",
+			Command: `exec 9>> '/run/chef lock'; if ! flock -n 9; then ` +
+				`echo "Waiting up to 1m30s for the chef-client lock '/run/chef lock', held by:"; ` +
+				`lslocks -n -o PID,PATH 2> /dev/null | while read pid file; do [ "$file" = '/run/chef lock' ] && ps -o pid=,args= -p "$pid"; done; ` +
+				`flock -w 90 9 || { echo "Timed out after 1m30s waiting for the chef-client lock '/run/chef lock', held by:"; ` +
+				`lslocks -n -o PID,PATH 2> /dev/null | while read pid file; do [ "$file" = '/run/chef lock' ] && ps -o pid=,args= -p "$pid"; done; exit 1; }; fi; ` +
+				`chef-client -z`,
+		},
+		"Windows": {
+			Config:     map[string]interface{}{"lock_timeout": "5m"},
+			Connection: "winrm",
+			Command:    "powershell -NoProfile -ExecutionPolicy Bypass -File C:/chef/app/" + lockScript,
+			Uploads: map[string]string{
+				"C:/chef/app/" + lockScript: `$lockFile = 'C:/ProgramData/chef-client.lock'
+$deadline = (Get-Date).AddSeconds(300)
+$lock = $null
+while ($lock -eq $null) {
+  try {
+    # Others may read who holds the lock, but not take it
+    $lock = [IO.File]::Open($lockFile, 'OpenOrCreate', 'ReadWrite', 'Read')
+  } catch [IO.IOException] {
+    $holder = Get-Content -Path $lockFile -ErrorAction SilentlyContinue
+    if ((Get-Date) -gt $deadline) {
+      Write-Output "Timed out after 5m0s waiting for the chef-client lock $lockFile, held by: $holder"
+      exit 1
+    }
+    Write-Output "Waiting up to 5m0s for the chef-client lock $lockFile, held by: $holder"
+    Start-Sleep -Seconds 10
+  }
+}
+$lock.SetLength(0)
+$writer = New-Object IO.StreamWriter($lock)
+$writer.WriteLine("pid $PID, bundle app, since $(Get-Date -Format o)")
+$writer.Flush()
+try {
+  & cmd /c 'chef-client -z'
+  $code = $LASTEXITCODE
+} finally {
+  $lock.Close()
+}
+exit $code`,
+			},
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"bundle_id":        "app",
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		state := &terraform.InstanceState{
+			Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{"type": tc.Connection}},
+		}
+		if err := p.configurePerOS(state); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		c := new(communicator.MockCommunicator)
+		c.Commands = map[string]bool{tc.Command: true}
+		c.Uploads = tc.Uploads
+		if err := p.runLocked(context.Background(), o, c, "chef-client -z"); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package chefsolo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// manifestFile lists the files of the bundle uploaded on the machine, it is
+// written in the sha256sum format so it can be checked by hand
+const manifestFile = ".chefsolo-manifest"
+
+// manifest maps the path of every file of the bundle, relative to the bundle
+// directory, to its sha256 checksum
+type manifest map[string]string
+
+func parseManifest(content string) manifest {
+	m := make(manifest)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimRight(scanner.Text(), "\r"), "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			continue
+		}
+		m[fields[1]] = fields[0]
+	}
+	return m
+}
+
+func (m manifest) String() string {
+	files := make([]string, 0, len(m))
+	for file := range m {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var b bytes.Buffer
+	for _, file := range files {
+		fmt.Fprintf(&b, "%s  %s\n", m[file], file)
+	}
+	return b.String()
+}
+
+// bundleSync describes an incremental upload of the bundle
+type bundleSync struct {
+	manifest manifest
+	changed  map[string]bool
+	deleted  []string
+}
+
+// diff compares the local manifest with the remote one
+func (m manifest) diff(remote manifest) *bundleSync {
+	sync := &bundleSync{manifest: m, changed: make(map[string]bool)}
+	for file, sum := range m {
+		if remote[file] != sum {
+			sync.changed[file] = true
+		}
+	}
+	for file := range remote {
+		if _, ok := m[file]; !ok && isSafeBundlePath(file) {
+			sync.deleted = append(sync.deleted, file)
+		}
+	}
+	sort.Strings(sync.deleted)
+	return sync
+}
+
+// isSafeBundlePath makes sure a path read from the machine can not point
+// outside of the bundle directory
+func isSafeBundlePath(file string) bool {
+	if file == "" || file == manifestFile || path.IsAbs(file) || strings.Contains(file, `\`) || strings.Contains(file, ":") {
+		return false
+	}
+	for _, part := range strings.Split(file, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// manifestArchiveWriter builds a manifest out of the files that would be
+// archived instead of archiving them
+type manifestArchiveWriter struct {
+	manifest manifest
+	prefix   string
+	symlinks bool
+}
+
+func (a *manifestArchiveWriter) writeDir(name string, info os.FileInfo) error {
+	return nil
+}
+
+func (a *manifestArchiveWriter) writeFile(name string, info os.FileInfo, r io.Reader) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	a.manifest[strings.TrimPrefix(name, a.prefix)] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+func (a *manifestArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	sum := sha256.Sum256([]byte("symlink:" + target))
+	a.manifest[strings.TrimPrefix(name, a.prefix)] = hex.EncodeToString(sum[:])
+	return nil
+}
+
+func (a *manifestArchiveWriter) keepsSymlinks() bool {
+	return a.symlinks
+}
+
+func (a *manifestArchiveWriter) Close() error {
+	return nil
+}
+
+// syncArchiveWriter only lets the changed files through
+type syncArchiveWriter struct {
+	archiveWriter
+	sync   *bundleSync
+	prefix string
+}
+
+func (a *syncArchiveWriter) writeFile(name string, info os.FileInfo, r io.Reader) error {
+	if !a.sync.changed[strings.TrimPrefix(name, a.prefix)] {
+		return nil
+	}
+	return a.archiveWriter.writeFile(name, info, r)
+}
+
+func (a *syncArchiveWriter) writeSymlink(name, target string, info os.FileInfo) error {
+	if !a.sync.changed[strings.TrimPrefix(name, a.prefix)] {
+		return nil
+	}
+	return a.archiveWriter.writeSymlink(name, target, info)
+}
+
+// generatedFileInfo describes a file generated on the fly to be archived
+type generatedFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *generatedFileInfo) Name() string       { return fi.name }
+func (fi *generatedFileInfo) Size() int64        { return fi.size }
+func (fi *generatedFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *generatedFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *generatedFileInfo) IsDir() bool        { return false }
+func (fi *generatedFileInfo) Sys() interface{}   { return nil }
+
+// localManifest computes the manifest of the bundle as it would be archived
+func (p *provisioner) localManifest(entries []archiveEntry) (manifest, error) {
+	mw := &manifestArchiveWriter{
+		manifest: make(manifest),
+		prefix:   p.BaseOutputDir + "/",
+		symlinks: p.archiveExtension() != ".zip",
+	}
+	for _, entry := range entries {
+		root, err := filepath.Abs(entry.src)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s: %v", entry.src, err)
+		}
+		if err := p.archiveTree(mw, root, root, entry.name, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return mw.manifest, nil
+}
+
+// prepareSync reads the manifest left on the machine by the previous upload,
+// through readCmd, and compares it with the local bundle
+func (p *provisioner) prepareSync(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	readCmd string, entries []archiveEntry) (*bundleSync, error) {
+	local, err := p.localManifest(entries)
+	if err != nil {
+		return nil, fmt.Errorf("error computing the bundle manifest: %v", err)
+	}
+
+	content, err := p.runRemoteOutput(ctx, o, comm, readCmd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the remote bundle manifest: %v", err)
+	}
+
+	sync := local.diff(parseManifest(content))
+	o.Output(fmt.Sprintf("Syncing bundle: %d of %d files changed, %d to remove",
+		len(sync.changed), len(local), len(sync.deleted)))
+	return sync, nil
+}
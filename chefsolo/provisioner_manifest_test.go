@@ -0,0 +1,155 @@
+package chefsolo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func testSum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifest_parse(t *testing.T) {
+	m := manifest{
+		"nodes/toto.json":          testSum("toto"),
+		"cookbooks/app/default.rb": testSum("app"),
+	}
+	content := m.String()
+	expected := testSum("app") + "  cookbooks/app/default.rb\n" + testSum("toto") + "  nodes/toto.json\n"
+	if content != expected {
+		t.Fatalf("expected %q, got %q", expected, content)
+	}
+
+	// Windows type adds carriage returns, garbage lines are ignored
+	parsed := parseManifest(strings.Replace(content, "\n", "\r\n", -1) + "garbage\n\n")
+	if !reflect.DeepEqual(parsed, m) {
+		t.Fatalf("expected %v, got %v", m, parsed)
+	}
+}
+
+func TestManifest_diff(t *testing.T) {
+	local := manifest{
+		"unchanged": testSum("unchanged"),
+		"changed":   testSum("new content"),
+		"added":     testSum("added"),
+	}
+	remote := manifest{
+		"unchanged":       testSum("unchanged"),
+		"changed":         testSum("old content"),
+		"nodes/old.json":  testSum("old"),
+		"../etc/passwd":   testSum("passwd"),
+		"/etc/shadow":     testSum("shadow"),
+		`C:\Windows\sys`:  testSum("sys"),
+		manifestFile:      testSum("manifest"),
+		"a/../../escaped": testSum("escaped"),
+	}
+
+	sync := local.diff(remote)
+	if expected := map[string]bool{"changed": true, "added": true}; !reflect.DeepEqual(sync.changed, expected) {
+		t.Fatalf("expected %v to change, got %v", expected, sync.changed)
+	}
+	if expected := []string{"nodes/old.json"}; !reflect.DeepEqual(sync.deleted, expected) {
+		t.Fatalf("expected %v to be deleted, got %v", expected, sync.deleted)
+	}
+}
+
+func TestResourceProvider_syncUpload(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"upload_mode":      "sync",
+	}
+
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p, err := configureProvisioner(
+		schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+		fs,
+	)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	afero.WriteFile(fs, "/output/nodes/toto.json", []byte(`{ "id":"toto"}`), 0644)
+	afero.WriteFile(fs, "/output/dna/toto.json", []byte(`{ "id":"toto", "run_list": [] }`), 0644)
+
+	remoteManifest := manifest{
+		"nodes/toto.json": testSum(`{ "id":"toto"}`),
+		"dna/toto.json":   testSum(`{ "id":"toto"}`),
+		"nodes/old.json":  testSum(`{ "id":"old"}`),
+	}
+
+	var commands []string
+	c := &uploadCommunicator{uploaded: make(map[string][]byte)}
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		commands = append(commands, cmd.Command)
+		if strings.HasPrefix(cmd.Command, "cat ") {
+			io.WriteString(cmd.Stdout, remoteManifest.String())
+		}
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+
+	if err := p.uploadArchive(context.Background(), new(terraform.MockUIOutput), c, linuxConfDir, linuxConfDir); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(c.uploaded[linuxConfDir+"/output.tar.gz"]))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			b, _ := ioutil.ReadAll(tr)
+			files[h.Name] = string(b)
+		}
+	}
+
+	expectedManifest := manifest{
+		"nodes/toto.json": testSum(`{ "id":"toto"}`),
+		"dna/toto.json":   testSum(`{ "id":"toto", "run_list": [] }`),
+	}
+	expected := map[string]string{
+		"output/dna/toto.json":   `{ "id":"toto", "run_list": [] }`,
+		"output/" + manifestFile: expectedManifest.String(),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected the archive to contain %v, got %v", expected, files)
+	}
+
+	if len(commands) != 3 {
+		t.Fatalf("expected 3 commands, got %q", commands)
+	}
+	if expected := "cat /opt/chef/0/output/" + manifestFile + " 2>/dev/null || true"; commands[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, commands[0])
+	}
+	if expected := "cd /opt/chef/0/output && rm -f -- nodes/old.json"; commands[2] != expected {
+		t.Fatalf("expected %q, got %q", expected, commands[2])
+	}
+}
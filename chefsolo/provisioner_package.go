@@ -0,0 +1,242 @@
+package chefsolo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	installMethodScript       = "script"
+	installMethodPackage      = "package"
+	aptKeyFile                = "/etc/apt/trusted.gpg.d/%s.asc"
+	aptRepoFile               = "/etc/apt/sources.list.d/%s.list"
+	rpmKeyFile                = "/etc/pki/rpm-gpg/RPM-GPG-KEY-%s"
+	yumRepoFile               = "/etc/yum.repos.d/%s.repo"
+	zypperRepoFile            = "/etc/zypp/repos.d/%s.repo"
+	packageManagerApt         = "apt-get"
+	packageManagerDnf         = "dnf"
+	packageManagerYum         = "yum"
+	packageManagerZypper      = "zypper"
+	distroDetectionCmd        = `. /etc/os-release; echo "$ID" "$VERSION_ID" "${VERSION_CODENAME:-none}"; command -v dnf yum apt-get zypper || true`
+	packageRepositoryTemplate = `{{ if eq .Manager "apt-get" -}}
+deb {{ .URL }} {{ .Codename }} main
+{{- else -}}
+[{{ .Product }}-{{ .Channel }}]
+name={{ .Product }}-{{ .Channel }}
+baseurl={{ .URL }}
+enabled=1
+gpgcheck=1
+gpgkey=file://{{ .KeyFile }}
+{{- end }}
+`
+)
+
+// linuxDistro describes the distribution of the machine
+type linuxDistro struct {
+	ID       string
+	Version  string
+	Codename string
+	Manager  string
+}
+
+// packageRepository describes the Chef repository for a distribution
+type packageRepository struct {
+	Manager  string
+	Product  string
+	Channel  string
+	URL      string
+	Codename string
+	RepoFile string
+	KeyFile  string
+}
+
+// detectDistro reads /etc/os-release and looks for the package managers
+// available on the machine
+func (p *provisioner) detectDistro(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) (*linuxDistro, error) {
+	out, err := p.runRemoteAsUserOutput(ctx, o, comm, distroDetectionCmd)
+	if err != nil {
+		return nil, fmt.Errorf("error detecting the distribution of the machine: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("error detecting the distribution of the machine: unexpected output %q", out)
+	}
+	d := &linuxDistro{ID: fields[0], Version: fields[1], Codename: fields[2]}
+
+	managers := make(map[string]bool)
+	for _, line := range lines[1:] {
+		managers[path.Base(strings.TrimSpace(line))] = true
+	}
+	for _, manager := range []string{packageManagerDnf, packageManagerYum, packageManagerApt, packageManagerZypper} {
+		if managers[manager] {
+			d.Manager = manager
+			break
+		}
+	}
+	if d.Manager == "" {
+		return nil, fmt.Errorf("no supported package manager found on %s %s, install_method %s requires "+
+			"one of dnf, yum, apt-get or zypper", d.ID, d.Version, installMethodPackage)
+	}
+	return d, nil
+}
+
+// repository returns the Chef repository matching the distribution
+func (p *provisioner) repository(d *linuxDistro) (*packageRepository, error) {
+	base := strings.TrimSuffix(p.PackageRepository, "/")
+	major := strings.SplitN(d.Version, ".", 2)[0]
+	product := p.dist.Product
+	r := &packageRepository{Manager: d.Manager, Product: product, Channel: p.Channel}
+
+	switch d.Manager {
+	case packageManagerApt:
+		if d.Codename == "none" {
+			return nil, fmt.Errorf("no release codename found for %s %s", d.ID, d.Version)
+		}
+		r.URL = fmt.Sprintf("%s/apt/%s", base, p.Channel)
+		r.Codename = d.Codename
+		r.RepoFile = fmt.Sprintf(aptRepoFile, product)
+		r.KeyFile = fmt.Sprintf(aptKeyFile, product)
+		return r, nil
+	case packageManagerZypper:
+		r.URL = fmt.Sprintf("%s/yum/%s/sles/%s/$basearch/", base, p.Channel, major)
+		r.RepoFile = fmt.Sprintf(zypperRepoFile, product)
+		r.KeyFile = fmt.Sprintf(rpmKeyFile, product)
+		return r, nil
+	}
+
+	// Amazon Linux uses the packages of the matching Enterprise Linux release
+	switch {
+	case d.ID == "amzn" && major == "2":
+		major = "7"
+	case d.ID == "amzn":
+		major = "9"
+	case d.ID == "fedora":
+		return nil, fmt.Errorf("no Chef repository for %s %s, use install_method %s", d.ID, d.Version, installMethodScript)
+	}
+	r.URL = fmt.Sprintf("%s/yum/%s/el/%s/$basearch/", base, p.Channel, major)
+	r.RepoFile = fmt.Sprintf(yumRepoFile, product)
+	r.KeyFile = fmt.Sprintf(rpmKeyFile, product)
+	return r, nil
+}
+
+// packageSpec returns the packages to install, pinned to the requested
+// version. zypper has no wildcard versions, so a version prefix becomes a
+// range, 14.10 asking for chef>=14.10 and chef<14.11
+func (p *provisioner) packageSpec(manager string) []string {
+	v, name := p.installVersion(), p.dist.Product
+	if anyVersion(v) {
+		return []string{name}
+	}
+	partial := strings.Count(v, ".") < 2
+	switch manager {
+	case packageManagerApt:
+		if partial {
+			return []string{name + "=" + v + ".*"}
+		}
+		return []string{name + "=" + v + "-*"}
+	case packageManagerZypper:
+		if partial {
+			return []string{name + ">=" + v, name + "<" + nextPrefix(v)}
+		}
+		return []string{name + "=" + v}
+	default:
+		if partial {
+			return []string{name + "-" + v + ".*"}
+		}
+		return []string{name + "-" + v}
+	}
+}
+
+// nextPrefix returns the version prefix following v, 15 for 14 and 14.11 for
+// 14.10
+func nextPrefix(v string) string {
+	segments := strings.Split(v, ".")
+	last, err := strconv.Atoi(segments[len(segments)-1])
+	if err != nil {
+		return v
+	}
+	segments[len(segments)-1] = strconv.Itoa(last + 1)
+	return strings.Join(segments, ".")
+}
+
+// installCommands returns the commands installing the chef package
+func (p *provisioner) installCommands(manager string) []string {
+	env := p.proxyEnv()
+	pkg := p.packageSpec(manager)
+	install := func(args ...string) string { return shellJoin(append(args, pkg...)...) }
+	switch manager {
+	case packageManagerApt:
+		return []string{
+			env + shellJoin("apt-get", "update"),
+			env + "DEBIAN_FRONTEND=noninteractive " + install("apt-get", "install", "-y", "--allow-downgrades"),
+		}
+	case packageManagerZypper:
+		return []string{
+			env + shellJoin("zypper", "--non-interactive", "refresh"),
+			env + install("zypper", "--non-interactive", "install", "--oldpackage"),
+		}
+	case packageManagerDnf:
+		return []string{env + install("dnf", "-y", "install")}
+	default:
+		// yum install does not downgrade
+		return []string{env + install("yum", "-y", "install") + " || " + env + install("yum", "-y", "downgrade")}
+	}
+}
+
+// linuxInstallChefFromRepository configures the package repository of the
+// distribution, or a mirror of it, and installs its package with the package
+// manager of the machine
+func (p *provisioner) linuxInstallChefFromRepository(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	distro, err := p.detectDistro(ctx, o, comm)
+	if err != nil {
+		return err
+	}
+	repo, err := p.repository(distro)
+	if err != nil {
+		return err
+	}
+	o.Output(fmt.Sprintf("Installing %s with %s from %s", repo.Product, repo.Manager, repo.URL))
+
+	staging, err := p.createStagingDir(ctx, o, comm)
+	if err != nil {
+		return err
+	}
+	defer p.removeStagingDir(ctx, o, comm, staging)
+
+	key := path.Join(staging, repo.Product+".asc")
+	download, err := p.downloadCommand(ctx, o, comm, p.PackageGPGKey, key)
+	if err != nil {
+		return err
+	}
+	if err := p.runWithRetries(ctx, o, comm, download); err != nil {
+		return fmt.Errorf("downloading %s failed: %v", p.PackageGPGKey, err)
+	}
+
+	var buf bytes.Buffer
+	t := template.Must(template.New("repository").Parse(packageRepositoryTemplate))
+	if err := t.Execute(&buf, repo); err != nil {
+		return fmt.Errorf("error executing repository template: %v", err)
+	}
+	repoFile := path.Join(staging, path.Base(repo.RepoFile))
+	if err := comm.Upload(repoFile, &buf); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", repo.RepoFile, err)
+	}
+
+	commands := []string{shellJoin("install", "-D", "-m", "644", "-o", "root", "-g", "root", key, repo.KeyFile)}
+	if repo.Manager != packageManagerApt {
+		commands = append(commands, shellJoin("rpm", "--import", repo.KeyFile))
+	}
+	commands = append(commands, shellJoin("install", "-D", "-m", "644", "-o", "root", "-g", "root", repoFile, repo.RepoFile))
+	return p.runMultipleCommands(ctx, o, comm, append(commands, p.installCommands(repo.Manager)...))
+}
@@ -0,0 +1,234 @@
+package chefsolo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_linuxInstallChefFromRepository(t *testing.T) {
+	sudo := func(cmd string) string { return "sudo bash -c " + shellQuote(cmd) }
+	key := testStagingDir + "/chef.asc"
+	download := "curl -fsSL -o " + key + " https://packages.chef.io/chef.asc"
+
+	cases := map[string]struct {
+		Config   map[string]interface{}
+		Distro   string
+		Commands map[string]bool
+		Uploads  map[string]string
+		Error    bool
+	}{
+		"Ubuntu": {
+			Config: map[string]interface{}{
+				"use_sudo": true,
+				"version":  "14.10.9",
+			},
+			Distro: "ubuntu 18.04 bionic\n/usr/bin/apt-get\n",
+			Commands: map[string]bool{
+				download: true,
+				sudo("install -D -m 644 -o root -g root " + key + " /etc/apt/trusted.gpg.d/chef.asc"):                        true,
+				sudo("install -D -m 644 -o root -g root " + testStagingDir + "/chef.list /etc/apt/sources.list.d/chef.list"): true,
+				sudo("apt-get update"): true,
+				sudo("DEBIAN_FRONTEND=noninteractive apt-get install -y --allow-downgrades 'chef=14.10.9-*'"): true,
+			},
+			Uploads: map[string]string{
+				testStagingDir + "/chef.list": "deb https://packages.chef.io/repos/apt/stable bionic main",
+			},
+		},
+
+		"CentOS": {
+			Config: map[string]interface{}{
+				"use_sudo": false,
+				"version":  "14.10",
+			},
+			Distro: "centos 7 none\n/usr/bin/yum\n",
+			Commands: map[string]bool{
+				download: true,
+				"install -D -m 644 -o root -g root " + key + " /etc/pki/rpm-gpg/RPM-GPG-KEY-chef":               true,
+				"rpm --import /etc/pki/rpm-gpg/RPM-GPG-KEY-chef":                                                true,
+				"install -D -m 644 -o root -g root " + testStagingDir + "/chef.repo /etc/yum.repos.d/chef.repo": true,
+				"yum -y install 'chef-14.10.*' || yum -y downgrade 'chef-14.10.*'":                              true,
+			},
+			Uploads: map[string]string{
+				testStagingDir + "/chef.repo": "[chef-stable]\nname=chef-stable\n" +
+					"baseurl=https://packages.chef.io/repos/yum/stable/el/7/$basearch/\nenabled=1\ngpgcheck=1\n" +
+					"gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-chef",
+			},
+		},
+
+		"RockyMirror": {
+			Config: map[string]interface{}{
+				"use_sudo":           true,
+				"channel":            "current",
+				"http_proxy":         "http://proxy.local",
+				"package_repository": "https://mirror.local/chef/",
+				"package_gpg_key":    "https://mirror.local/chef.asc",
+			},
+			Distro: "rocky 8.5 none\n/usr/bin/dnf\n/usr/bin/yum\n",
+			Commands: map[string]bool{
+				"http_proxy=http://proxy.local curl -fsSL -o " + key + " https://mirror.local/chef.asc":               true,
+				sudo("install -D -m 644 -o root -g root " + key + " /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):               true,
+				sudo("rpm --import /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):                                                true,
+				sudo("install -D -m 644 -o root -g root " + testStagingDir + "/chef.repo /etc/yum.repos.d/chef.repo"): true,
+				sudo("http_proxy=http://proxy.local dnf -y install chef"):                                             true,
+			},
+			Uploads: map[string]string{
+				testStagingDir + "/chef.repo": "[chef-current]\nname=chef-current\n" +
+					"baseurl=https://mirror.local/chef/yum/current/el/8/$basearch/\nenabled=1\ngpgcheck=1\n" +
+					"gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-chef",
+			},
+		},
+
+		"SLES": {
+			Config: map[string]interface{}{
+				"use_sudo": true,
+				"version":  "15.0.300",
+			},
+			Distro: "sles 15.1 none\n/usr/bin/zypper\n",
+			Commands: map[string]bool{
+				download: true,
+				sudo("install -D -m 644 -o root -g root " + key + " /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):                true,
+				sudo("rpm --import /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):                                                 true,
+				sudo("install -D -m 644 -o root -g root " + testStagingDir + "/chef.repo /etc/zypp/repos.d/chef.repo"): true,
+				sudo("zypper --non-interactive refresh"):                                                               true,
+				sudo("zypper --non-interactive install --oldpackage chef=15.0.300"):                                    true,
+			},
+			Uploads: map[string]string{
+				testStagingDir + "/chef.repo": "[chef-stable]\nname=chef-stable\n" +
+					"baseurl=https://packages.chef.io/repos/yum/stable/sles/15/$basearch/\nenabled=1\ngpgcheck=1\n" +
+					"gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-chef",
+			},
+		},
+
+		"SLES partial": {
+			Config: map[string]interface{}{
+				"use_sudo": true,
+				"version":  "14.10",
+			},
+			Distro: "sles 15.1 none\n/usr/bin/zypper\n",
+			Commands: map[string]bool{
+				download: true,
+				sudo("install -D -m 644 -o root -g root " + key + " /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):                true,
+				sudo("rpm --import /etc/pki/rpm-gpg/RPM-GPG-KEY-chef"):                                                 true,
+				sudo("install -D -m 644 -o root -g root " + testStagingDir + "/chef.repo /etc/zypp/repos.d/chef.repo"): true,
+				sudo("zypper --non-interactive refresh"):                                                               true,
+				sudo("zypper --non-interactive install --oldpackage 'chef>=14.10' 'chef<14.11'"):                       true,
+			},
+			Uploads: map[string]string{
+				testStagingDir + "/chef.repo": "[chef-stable]\nname=chef-stable\n" +
+					"baseurl=https://packages.chef.io/repos/yum/stable/sles/15/$basearch/\nenabled=1\ngpgcheck=1\n" +
+					"gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-chef",
+			},
+		},
+
+		"NoPackageManager": {
+			Config:   map[string]interface{}{"use_sudo": true},
+			Distro:   "alpine 3.8.1 none\n",
+			Commands: map[string]bool{},
+			Error:    true,
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+	c := new(communicator.MockCommunicator)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"install_method":   "package",
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+
+		tc.Commands[distroDetectionCmd] = true
+		tc.Commands["mktemp -d /tmp/chefsolo.XXXXXXXXXX"] = true
+		tc.Commands["command -v curl wget || true"] = true
+		tc.Commands["rm -rf "+testStagingDir] = true
+		c.CommandFunc = outputCommandFunc(tc.Commands, map[string]string{
+			distroDetectionCmd:             tc.Distro,
+			"command -v curl wget || true": "/usr/bin/curl\n",
+		})
+		c.Uploads = tc.Uploads
+
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		err = p.linuxInstallChefClient(context.Background(), o, c)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+	}
+}
+
+func TestResourceProvider_packageRepository(t *testing.T) {
+	cases := map[string]struct {
+		Distro linuxDistro
+		URL    string
+		Error  bool
+	}{
+		"Debian": {
+			Distro: linuxDistro{ID: "debian", Version: "9", Codename: "stretch", Manager: packageManagerApt},
+			URL:    "https://packages.chef.io/repos/apt/stable",
+		},
+		"Debian without codename": {
+			Distro: linuxDistro{ID: "debian", Version: "8", Codename: "none", Manager: packageManagerApt},
+			Error:  true,
+		},
+		"Amazon Linux 2": {
+			Distro: linuxDistro{ID: "amzn", Version: "2", Codename: "none", Manager: packageManagerYum},
+			URL:    "https://packages.chef.io/repos/yum/stable/el/7/$basearch/",
+		},
+		"RHEL": {
+			Distro: linuxDistro{ID: "rhel", Version: "8.2", Codename: "none", Manager: packageManagerDnf},
+			URL:    "https://packages.chef.io/repos/yum/stable/el/8/$basearch/",
+		},
+		"Fedora": {
+			Distro: linuxDistro{ID: "fedora", Version: "30", Codename: "none", Manager: packageManagerDnf},
+			Error:  true,
+		},
+	}
+
+	for k, tc := range cases {
+		p := &provisioner{
+			Channel:           "stable",
+			PackageRepository: distributions[distributionChef].Repository,
+			dist:              distributions[distributionChef],
+		}
+		repo, err := p.repository(&tc.Distro)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if err == nil && repo.URL != tc.URL {
+			t.Fatalf("Test %q failed: expected %s, got %s", k, tc.URL, repo.URL)
+		}
+	}
+}
+
+func TestNextPrefix(t *testing.T) {
+	cases := map[string]string{
+		"14":    "15",
+		"14.10": "14.11",
+		"14.9":  "14.10",
+	}
+	for v, expected := range cases {
+		if next := nextPrefix(v); next != expected {
+			t.Fatalf("nextPrefix(%q): expected %q, got %q", v, expected, next)
+		}
+	}
+}
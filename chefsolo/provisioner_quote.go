@@ -0,0 +1,94 @@
+package chefsolo
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Characters that never need quoting, whatever the shell
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_@+=:,./-]+$`)
+
+// Characters cmd.exe never splits on, its built-ins also treat = , and ; as
+// argument delimiters
+var safeCmdWord = regexp.MustCompile(`^[A-Za-z0-9_@+:./\\-]+$`)
+
+// A symbol which can be written without quotes
+var rubyWord = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// shellQuote quotes s so that a POSIX shell reads it back as a single word
+func shellQuote(s string) string {
+	if safeShellWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellJoin quotes every word and joins them into a POSIX command line
+func shellJoin(words ...string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = shellQuote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// cmdQuote quotes s so that cmd.exe reads it back as a single argument.
+// Percent signs are escaped outside of the quotes, as cmd would otherwise
+// expand them as variables even within a quoted string.
+func cmdQuote(s string) string {
+	if safeCmdWord.MatchString(s) {
+		return s
+	}
+	s = strings.Replace(s, `"`, `""`, -1)
+	s = strings.Replace(s, "%", `"^%"`, -1)
+	return `"` + s + `"`
+}
+
+// batchQuote quotes s for a line of a batch file, in which percent signs are
+// doubled as the caret does not escape them
+func batchQuote(s string) string {
+	if safeCmdWord.MatchString(s) {
+		return s
+	}
+	s = strings.Replace(s, `"`, `""`, -1)
+	s = strings.Replace(s, "%", "%%", -1)
+	return `"` + s + `"`
+}
+
+// cmdToBatch turns a command line quoted with cmdQuote into a line of a batch
+// file
+func cmdToBatch(command string) string {
+	return strings.Replace(command, `"^%"`, "%%", -1)
+}
+
+// rubyQuote quotes s as a single-quoted Ruby string, in which only the
+// backslash and the quote itself are special and nothing is interpolated
+func rubyQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// rubySymbol writes name as a Ruby symbol, quoted unless it is a plain word
+func rubySymbol(name string) string {
+	name = strings.TrimPrefix(name, ":")
+	if rubyWord.MatchString(name) {
+		return ":" + name
+	}
+	return ":" + rubyQuote(name)
+}
+
+// powershellQuote quotes s as a PowerShell verbatim string, in which nothing
+// gets expanded
+func powershellQuote(s string) string {
+	// PowerShell also treats the typographic single quotes as delimiters
+	r := strings.NewReplacer("'", "''", "‘", "‘‘", "’", "’’",
+		"‚", "‚‚", "‛", "‛‛")
+	return "'" + r.Replace(s) + "'"
+}
+
+// quote quotes s for the shell of the targeted OS
+func (p *provisioner) quote(s string) string {
+	if p.OSType == "windows" {
+		return cmdQuote(s)
+	}
+	return shellQuote(s)
+}
@@ -0,0 +1,170 @@
+package chefsolo
+
+import (
+	"os/exec"
+	"testing"
+)
+
+var hostileInputs = []string{
+	"",
+	"simple",
+	"/opt/chef/0/output",
+	"with space",
+	"it's",
+	"'",
+	"''",
+	`"double"`,
+	`back\slash`,
+	"$(touch /tmp/pwned)",
+	"`touch /tmp/pwned`",
+	"${HOME}",
+	"a; rm -rf /",
+	"a && b || c",
+	"a | b > c < d",
+	"*",
+	"~",
+	"new\nline",
+	"tab\there",
+	"-E",
+	"%PATH%",
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                  "''",
+		"simple":            "simple",
+		"/opt/chef/0":       "/opt/chef/0",
+		"http://proxy:80":   "http://proxy:80",
+		"with space":        "'with space'",
+		"it's":              `'it'\''s'`,
+		"$(id)":             "'$(id)'",
+		"a;b":               "'a;b'",
+		"~":                 "'~'",
+		"new\nline":         "'new\nline'",
+		`back\slash`:        `'back\slash'`,
+		"double \"quotes\"": `'double "quotes"'`,
+	}
+	for in, expected := range cases {
+		if got := shellQuote(in); got != expected {
+			t.Fatalf("shellQuote(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestShellQuote_roundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	for _, in := range hostileInputs {
+		// A single level, as used for command arguments
+		out, err := exec.Command(sh, "-c", "printf %s "+shellQuote(in)).Output()
+		if err != nil {
+			t.Fatalf("shellQuote(%q): %v", in, err)
+		}
+		if string(out) != in {
+			t.Fatalf("shellQuote(%q): shell read back %q", in, out)
+		}
+
+		// Two levels, as used when escalating privileges with sh -c
+		out, err = exec.Command(sh, "-c", "sh -c "+shellQuote("printf %s "+shellQuote(in))).Output()
+		if err != nil {
+			t.Fatalf("shellQuote(%q): %v", in, err)
+		}
+		if string(out) != in {
+			t.Fatalf("shellQuote(%q): nested shell read back %q", in, out)
+		}
+	}
+}
+
+func TestCmdQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                 `""`,
+		"C:/chef":          "C:/chef",
+		"C:/chef/my dir":   `"C:/chef/my dir"`,
+		`C:\chef\app`:      `C:\chef\app`,
+		"C:/chef/a=b":      `"C:/chef/a=b"`,
+		"C:/chef/a,b":      `"C:/chef/a,b"`,
+		"C:/chef/a;b":      `"C:/chef/a;b"`,
+		`say "hi"`:         `"say ""hi"""`,
+		"%PATH%":           `""^%"PATH"^%""`,
+		"a & b":            `"a & b"`,
+		"a | b > c":        `"a | b > c"`,
+		"it's":             `"it's"`,
+		"^caret":           `"^caret"`,
+		"with space & 50%": `"with space & 50"^%""`,
+	}
+	for in, expected := range cases {
+		if got := cmdQuote(in); got != expected {
+			t.Fatalf("cmdQuote(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestBatchQuote(t *testing.T) {
+	cases := map[string]string{
+		"C:/chef":          "C:/chef",
+		"C:/chef/my dir":   `"C:/chef/my dir"`,
+		`say "hi"`:         `"say ""hi"""`,
+		"%PATH%":           `"%%PATH%%"`,
+		"with space & 50%": `"with space & 50%%"`,
+	}
+	for in, expected := range cases {
+		if got := batchQuote(in); got != expected {
+			t.Fatalf("batchQuote(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestCmdToBatch(t *testing.T) {
+	command := "chef-client -j " + cmdQuote("C:/chef/100%/dna.json") + " -o " + cmdQuote("recipe[a]")
+	expected := `chef-client -j "C:/chef/100%%/dna.json" -o "recipe[a]"`
+	if got := cmdToBatch(command); got != expected {
+		t.Fatalf("cmdToBatch(%q): expected %q, got %q", command, expected, got)
+	}
+}
+
+func TestPowershellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                  "''",
+		"stable":            "'stable'",
+		"it's":              "'it''s'",
+		"$(Remove-Item C:)": "'$(Remove-Item C:)'",
+		"`n":                "'`n'",
+		`"double"`:          `'"double"'`,
+		"it’s":              "'it’’s'",
+	}
+	for in, expected := range cases {
+		if got := powershellQuote(in); got != expected {
+			t.Fatalf("powershellQuote(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestRubyQuote(t *testing.T) {
+	cases := map[string]string{
+		"":                 `''`,
+		"/opt/chef/0":      `'/opt/chef/0'`,
+		"it's":             `'it\'s'`,
+		`C:\chef\`:         `'C:\\chef\\'`,
+		`"#{system('id')}`: `'"#{system(\'id\')}'`,
+	}
+	for in, expected := range cases {
+		if got := rubyQuote(in); got != expected {
+			t.Fatalf("rubyQuote(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestRubySymbol(t *testing.T) {
+	cases := map[string]string{
+		"verify_peer":  ":verify_peer",
+		":verify_none": ":verify_none",
+		"a b'":         `:'a b\''`,
+	}
+	for in, expected := range cases {
+		if got := rubySymbol(in); got != expected {
+			t.Fatalf("rubySymbol(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	rebootHandlingNone   = "none"
+	rebootHandlingAccept = "accept"
+	rebootHandlingReboot = "reboot"
+	// chef-client exit codes asking for a reboot, chef reboots the machine
+	// itself at the end of the run on exitRebootScheduled
+	exitRebootScheduled = 35
+	exitRebootNeeded    = 37
+	linuxBootIDCmd      = "cat /proc/sys/kernel/random/boot_id"
+	linuxRebootCmd      = "nohup sh -c 'sleep 2 && shutdown -r now' >/dev/null 2>&1 &"
+	windowsBootIDCmd    = `powershell -NoProfile -Command "(Get-CimInstance Win32_OperatingSystem).LastBootUpTime.ToUniversalTime().ToString('o')"`
+	windowsRebootCmd    = `shutdown /r /t 5 /c "chef-client requested a reboot"`
+)
+
+var rebootHandlings = []string{rebootHandlingNone, rebootHandlingAccept, rebootHandlingReboot}
+
+func isValidRebootHandling(handling string) bool {
+	for _, h := range rebootHandlings {
+		if h == handling {
+			return true
+		}
+	}
+	return false
+}
+
+// exitStatus returns the exit status of a remote command from the error
+// returned by Wait, false when the command did not run to completion
+func exitStatus(err error) (int, bool) {
+	if err == nil {
+		return 0, true
+	}
+	if e, ok := err.(*remote.ExitError); ok && e.Err == nil {
+		return e.ExitStatus, true
+	}
+	return 0, false
+}
+
+func isRebootExitStatus(status int) bool {
+	return status == exitRebootScheduled || status == exitRebootNeeded
+}
+
+// isSuccessExitStatus tells whether a chef-client exit status is a success,
+// 0 or one of success_exit_codes
+func (p *provisioner) isSuccessExitStatus(status int) bool {
+	if status == 0 {
+		return true
+	}
+	for _, code := range p.SuccessExitCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// runChefPasses runs chef-client, and with reboot_handling reboot, reboots
+// the machine and runs it again as long as it asks for a reboot, up to
+// max_passes runs
+func (p *provisioner) runChefPasses(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	command string) error {
+	for pass := 1; ; pass++ {
+		err := p.runChefCommand(ctx, o, comm, command)
+		status, ok := exitStatus(err)
+		switch {
+		case !ok:
+			return err
+		case p.isSuccessExitStatus(status):
+			return nil
+		case !isRebootExitStatus(status):
+			return err
+		case p.RebootHandling == rebootHandlingNone:
+			return err
+		case p.RebootHandling == rebootHandlingAccept:
+			o.Output(fmt.Sprintf("chef-client requested a reboot (exit status %d), the machine is left to reboot", status))
+			return nil
+		case pass >= p.MaxPasses:
+			return fmt.Errorf("chef-client still requests a reboot after %d passes", pass)
+		}
+
+		if err := p.rebootMachine(ctx, o, comm, status); err != nil {
+			return err
+		}
+		o.Output(fmt.Sprintf("Starting Chef-Client pass %d of %d...", pass+1, p.MaxPasses))
+	}
+}
+
+// bootID returns a value which changes each time the machine boots
+func (p *provisioner) bootID(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) (string, error) {
+	var out string
+	var err error
+	if p.OSType == "windows" {
+		out, err = p.runRemoteOutput(ctx, o, comm, windowsBootIDCmd)
+	} else {
+		out, err = p.runRemoteAsUserOutput(ctx, o, comm, linuxBootIDCmd)
+	}
+	if err != nil {
+		return "", err
+	}
+	if out = strings.TrimSpace(out); out == "" {
+		return "", fmt.Errorf("empty boot id")
+	}
+	return out, nil
+}
+
+// rebootMachine reboots the machine unless chef-client already scheduled the
+// reboot, and waits for the communicator to reconnect once it is back
+func (p *provisioner) rebootMachine(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	status int) error {
+	// An unknown boot id only means the machine is already going down
+	before, err := p.bootID(ctx, o, comm)
+	if err != nil {
+		o.Output(fmt.Sprintf("Unable to read the boot id before the reboot: %v", err))
+	}
+
+	if status == exitRebootNeeded {
+		o.Output("chef-client needs a reboot, rebooting the machine...")
+		rebootCmd := linuxRebootCmd
+		if p.OSType == "windows" {
+			rebootCmd = windowsRebootCmd
+		}
+		if err := p.runRemote(ctx, o, comm, rebootCmd); err != nil {
+			return fmt.Errorf("error rebooting the machine: %v", err)
+		}
+	} else {
+		o.Output("chef-client scheduled a reboot, waiting for the machine to reboot...")
+	}
+
+	if err := comm.Disconnect(); err != nil {
+		return fmt.Errorf("error disconnecting before the reboot: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.RebootTimeout)
+	defer cancel()
+	start := time.Now()
+	// Without the boot id from before the reboot, a machine is only known to
+	// have rebooted once it went down
+	down := false
+	err = communicator.Retry(ctx, func() error {
+		if err := comm.Connect(o); err != nil {
+			down = true
+			return err
+		}
+		after, err := p.bootID(ctx, o, comm)
+		switch {
+		case err != nil:
+			down = true
+		case before == "" && !down:
+			before = after
+			err = fmt.Errorf("the machine has not rebooted yet")
+		case after == before:
+			err = fmt.Errorf("the machine has not rebooted yet")
+		}
+		if err != nil {
+			comm.Disconnect()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reconnecting after the reboot: %v", err)
+	}
+	o.Output(fmt.Sprintf("The machine is back after %s", time.Since(start).Round(time.Second)))
+	return nil
+}
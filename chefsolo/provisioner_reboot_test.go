@@ -0,0 +1,182 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_runChefPasses(t *testing.T) {
+	cases := map[string]struct {
+		Config  map[string]interface{}
+		Exits   []int
+		Runs    int
+		Reboots int
+		Error   bool
+	}{
+		"Success": {
+			Config: map[string]interface{}{},
+			Exits:  []int{0},
+			Runs:   1,
+		},
+		"Failure": {
+			Config: map[string]interface{}{},
+			Exits:  []int{1},
+			Runs:   1,
+			Error:  true,
+		},
+		"Extra success code": {
+			Config: map[string]interface{}{"success_exit_codes": []interface{}{2, 213}},
+			Exits:  []int{213},
+			Runs:   1,
+		},
+		"Reboot not handled": {
+			Config: map[string]interface{}{},
+			Exits:  []int{exitRebootNeeded},
+			Runs:   1,
+			Error:  true,
+		},
+		"Reboot code as success": {
+			Config: map[string]interface{}{"success_exit_codes": []interface{}{exitRebootNeeded}},
+			Exits:  []int{exitRebootNeeded},
+			Runs:   1,
+		},
+		"Reboot accepted": {
+			Config: map[string]interface{}{"reboot_handling": "accept"},
+			Exits:  []int{exitRebootScheduled},
+			Runs:   1,
+		},
+		"Reboot needed": {
+			Config:  map[string]interface{}{"reboot_handling": "reboot"},
+			Exits:   []int{exitRebootNeeded, 0},
+			Runs:    2,
+			Reboots: 1,
+		},
+		"Reboot scheduled": {
+			Config: map[string]interface{}{"reboot_handling": "reboot"},
+			Exits:  []int{exitRebootScheduled, exitRebootNeeded, 0},
+			Runs:   3,
+			// chef-client reboots the machine itself on a scheduled reboot
+			Reboots: 1,
+		},
+		"Too many passes": {
+			Config:  map[string]interface{}{"reboot_handling": "reboot", "max_passes": 2},
+			Exits:   []int{exitRebootNeeded, exitRebootNeeded, 0},
+			Runs:    2,
+			Reboots: 1,
+			Error:   true,
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		// Every disconnection stands for a reboot of the machine
+		boots, runs, reboots := 0, 0, 0
+		c := new(communicator.MockCommunicator)
+		c.DisconnectFunc = func() error {
+			boots++
+			return nil
+		}
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			switch cmd.Command {
+			case "chef-client":
+				if runs >= len(tc.Exits) {
+					t.Fatalf("Test %q failed: unexpected run %d", k, runs+1)
+				}
+				cmd.SetExitStatus(tc.Exits[runs], nil)
+				runs++
+			case linuxBootIDCmd:
+				io.WriteString(cmd.Stdout, fmt.Sprintf("boot-%d\n", boots))
+				cmd.SetExitStatus(0, nil)
+			case linuxRebootCmd:
+				reboots++
+				cmd.SetExitStatus(0, nil)
+			default:
+				t.Fatalf("Test %q failed: unexpected command %q", k, cmd.Command)
+			}
+			return nil
+		}
+
+		err := p.runChefPasses(context.Background(), o, c, "chef-client")
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if runs != tc.Runs || reboots != tc.Reboots {
+			t.Fatalf("Test %q failed: expected %d runs and %d reboots, got %d and %d",
+				k, tc.Runs, tc.Reboots, runs, reboots)
+		}
+	}
+}
+
+func TestResourceProvider_rebootMachineUnknownBootID(t *testing.T) {
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": `/input`,
+		"output_dir":       `/output`,
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+		"reboot_handling":  "reboot",
+	}
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/input", 0766)
+	p := testProvisioner(t, fs, config)
+	if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The boot id can not be read before the reboot, and the machine is
+	// still up at the first read after it
+	reads := []string{"", "boot-0", "boot-1"}
+	read := 0
+	c := new(communicator.MockCommunicator)
+	c.CommandFunc = func(cmd *remote.Cmd) error {
+		switch cmd.Command {
+		case linuxBootIDCmd:
+			if read >= len(reads) {
+				t.Fatalf("unexpected boot id read %d", read+1)
+			}
+			if reads[read] == "" {
+				read++
+				return fmt.Errorf("connection reset by peer")
+			}
+			io.WriteString(cmd.Stdout, reads[read]+"\n")
+			read++
+		case linuxRebootCmd:
+		default:
+			t.Fatalf("unexpected command %q", cmd.Command)
+		}
+		cmd.SetExitStatus(0, nil)
+		return nil
+	}
+
+	if err := p.rebootMachine(context.Background(), new(terraform.MockUIOutput), c, exitRebootNeeded); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if read != len(reads) {
+		t.Fatalf("expected the reboot to be confirmed by a new boot id, got %d reads", read)
+	}
+}
@@ -2,6 +2,7 @@ package chefsolo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/hashicorp/terraform/communicator"
 	"github.com/hashicorp/terraform/terraform"
@@ -11,15 +12,20 @@ import (
 	"text/template"
 )
 
-func (p *provisioner) prepareMachine(o terraform.UIOutput, comm communicator.Communicator, confDir string) error {
+func (p *provisioner) prepareMachine(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator,
+	confDir string) error {
 	o.Output("Uploading config files")
-	if err := p.osUploadConfigFiles(o, comm); err != nil {
+	if err := p.inPhase(ctx, o, comm, "upload", p.UploadTimeout, func(ctx context.Context) error {
+		return p.osUploadConfigFiles(ctx, p.output(o, "upload"), comm)
+	}); err != nil {
 		return err
 	}
 
 	if !p.SkipInstall {
 		o.Output("Installing chef client")
-		if err := p.installChefClient(o, comm); err != nil {
+		if err := p.inPhase(ctx, o, comm, "install", p.InstallTimeout, func(ctx context.Context) error {
+			return p.ensureChefClient(ctx, p.output(o, "install"), comm)
+		}); err != nil {
 			return err
 		}
 	}
@@ -27,9 +33,12 @@ func (p *provisioner) prepareMachine(o terraform.UIOutput, comm communicator.Com
 }
 
 func (p *provisioner) uploadClientConf(comm communicator.Communicator, confDir string) error {
-	// Make strings.Join available for use within the template
+	// Make strings.Join and the Ruby quoting available for use within the
+	// template
 	funcMap := template.FuncMap{
-		"join": strings.Join,
+		"join":       strings.Join,
+		"ruby":       rubyQuote,
+		"rubySymbol": rubySymbol,
 	}
 
 	// Create a new template and parse the client config into it
@@ -1,8 +1,18 @@
 package chefsolo
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
 	"github.com/hashicorp/terraform/communicator"
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -25,6 +35,86 @@ func getStringList(v interface{}) []string {
 	}
 }
 
+// nodeID parses a node JSON document and returns its id
+func nodeID(node string) (string, error) {
+	tmp := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(node), &tmp); err != nil {
+		return "", fmt.Errorf("error unable to render json %s: %v", node, err)
+	}
+	id, ok := tmp["id"].(string)
+	if !ok || id == "" {
+		return "", fmt.Errorf("error node %s must have a string id", node)
+	}
+	return id, nil
+}
+
+var bundleIDChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// defaultBundleID names the bundle after the output directory, along with a
+// hash of the instance and of output_dir as configured, so two output
+// directories with the same name do not collide on the machine. A relative
+// output_dir keeps the same id whatever the checkout it is applied from.
+func defaultBundleID(instanceID, outputDir string) string {
+	outputDir = filepath.ToSlash(filepath.Clean(outputDir))
+	sum := sha256.Sum256([]byte(instanceID + "\x00" + outputDir))
+	name := bundleIDChars.ReplaceAllString(path.Base(outputDir), "_")
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+func isValidSHA256(sum string) bool {
+	return sha256Hex.MatchString(sum)
+}
+
+func isValidBundleID(id string) bool {
+	return id != "" && id != "." && id != ".." && !bundleIDChars.MatchString(id)
+}
+
+// canonicalJSON re-encodes a json document with sorted keys and a stable
+// indentation, so equal documents get the same bytes
+func canonicalJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the json document")
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getConfigBool returns the boolean value of key and whether it is known yet,
+// an unset key being known as false.
+// Booleans coming from interpolations are still strings at plan time.
+func getConfigBool(c *terraform.ResourceConfig, key string) (bool, bool) {
+	if c.IsComputed(key) {
+		return false, false
+	}
+	v, ok := c.Get(key)
+	if !ok {
+		return false, true
+	}
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
 func getCommunicator(ctx context.Context, o terraform.UIOutput, s *terraform.InstanceState) (communicator.Communicator, error) {
 	// Get a new communicator
 	comm, err := communicator.New(s)
@@ -42,12 +132,5 @@ func getCommunicator(ctx context.Context, o terraform.UIOutput, s *terraform.Ins
 	if err != nil {
 		return nil, err
 	}
-
-	// Wait for the context to end and then disconnect
-	go func() {
-		<-ctx.Done()
-		comm.Disconnect()
-	}()
-
-	return comm, err
+	return comm, nil
 }
@@ -0,0 +1,294 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const (
+	versionPolicyExact      = "exact"
+	versionPolicyMinimum    = "minimum"
+	versionPolicyConstraint = "constraint"
+	versionLatest           = "latest"
+	// maxSegment stands for the unknown segments of a version prefix, the
+	// installer resolving 14 to the latest 14.x
+	maxSegment = 999999
+)
+
+var chefVersion = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+// anyVersion is true when version does not ask for a specific version, in
+// which case any installed chef-client is kept
+func anyVersion(v string) bool {
+	return v == "" || v == versionLatest
+}
+
+// checkVersion validates version against version_policy
+func checkVersion(v, policy string) error {
+	switch policy {
+	case versionPolicyExact, versionPolicyMinimum:
+		if anyVersion(v) {
+			return nil
+		}
+		if _, err := version.NewVersion(v); err != nil {
+			return fmt.Errorf("version %q can not be used with version_policy %s: %v", v, policy, err)
+		}
+	case versionPolicyConstraint:
+		if anyVersion(v) {
+			return fmt.Errorf("version_policy %s requires a version constraint such as \"~> 14.10\"", policy)
+		}
+		if _, err := installConstraint(v); err != nil {
+			return fmt.Errorf("version %q is not a valid constraint: %v", v, err)
+		}
+	default:
+		return fmt.Errorf("unsupported version_policy %q, must be one of: %s, %s, %s",
+			policy, versionPolicyExact, versionPolicyMinimum, versionPolicyConstraint)
+	}
+	return nil
+}
+
+// parseChefVersion extracts the version from the output of chef-client --version
+func parseChefVersion(out string) (*version.Version, error) {
+	match := chefVersion.FindString(out)
+	if match == "" {
+		return nil, fmt.Errorf("no version found in %q", strings.TrimSpace(out))
+	}
+	return version.NewVersion(match)
+}
+
+// versionSatisfied tells whether the installed version meets version and
+// version_policy. With the exact policy, only the segments given in version
+// are compared, so 14.10 is satisfied by 14.10.9.
+func (p *provisioner) versionSatisfied(installed *version.Version) (bool, error) {
+	if anyVersion(p.Version) {
+		return true, nil
+	}
+	switch p.VersionPolicy {
+	case versionPolicyConstraint:
+		constraints, err := version.NewConstraint(p.Version)
+		if err != nil {
+			return false, err
+		}
+		return constraints.Check(installed), nil
+	case versionPolicyMinimum:
+		wanted, err := version.NewVersion(p.Version)
+		if err != nil {
+			return false, err
+		}
+		return !installed.LessThan(wanted), nil
+	default:
+		wanted, err := version.NewVersion(p.Version)
+		if err != nil {
+			return false, err
+		}
+		if wanted.Prerelease() != installed.Prerelease() {
+			return false, nil
+		}
+		given := len(strings.Split(strings.SplitN(strings.SplitN(p.Version, "-", 2)[0], "+", 2)[0], "."))
+		for i, segment := range wanted.Segments() {
+			if i >= given {
+				break
+			}
+			if i >= len(installed.Segments()) || installed.Segments()[i] != segment {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// installVersion returns the version passed to the installer, a constraint
+// being resolved by installConstraint
+func (p *provisioner) installVersion() string {
+	if p.VersionPolicy != versionPolicyConstraint {
+		return p.Version
+	}
+	v, err := installConstraint(p.Version)
+	if err != nil {
+		// Rejected by the validation already, the installer fails on it
+		// rather than installing a version out of the constraint
+		return p.Version
+	}
+	return v
+}
+
+// installConstraint turns a constraint into the highest version the
+// installer understands which satisfies it. Each upper bound gives a
+// candidate version or version prefix, the highest one whose versions all
+// satisfy the constraint wins. Without an upper bound the latest version
+// satisfies it.
+func installConstraint(v string) (string, error) {
+	constraints, err := version.NewConstraint(v)
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	bounded := false
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		switch {
+		case strings.HasPrefix(c, "~>"):
+			segments := strings.Split(strings.TrimSpace(strings.TrimPrefix(c, "~>")), ".")
+			if len(segments) > 1 {
+				segments = segments[:len(segments)-1]
+			}
+			candidates = append(candidates, strings.Join(segments, "."))
+		case strings.HasPrefix(c, "<="):
+			candidates = append(candidates, fullVersion(strings.TrimPrefix(c, "<=")))
+		case strings.HasPrefix(c, "<"):
+			if below := versionBelow(strings.TrimSpace(strings.TrimPrefix(c, "<"))); below != "" {
+				candidates = append(candidates, below)
+			}
+		case strings.HasPrefix(c, ">"), strings.HasPrefix(c, "!="):
+			continue
+		case strings.HasPrefix(c, "="):
+			candidates = append(candidates, fullVersion(strings.TrimPrefix(c, "=")))
+		default:
+			candidates = append(candidates, fullVersion(c))
+		}
+		bounded = true
+	}
+	if !bounded {
+		return versionLatest, nil
+	}
+
+	var best string
+	var bestTop *version.Version
+	for _, candidate := range candidates {
+		top, err := highestVersion(candidate)
+		if err != nil || !constraints.Check(top) {
+			continue
+		}
+		if bestTop == nil || top.GreaterThan(bestTop) {
+			best, bestTop = candidate, top
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no version the installer understands satisfies it")
+	}
+	return best, nil
+}
+
+// fullVersion returns v with all its segments, as = 14.10 and <= 14.10 mean
+// 14.10.0 and not the latest 14.10.x
+func fullVersion(v string) string {
+	parsed, err := version.NewVersion(strings.TrimSpace(v))
+	if err != nil {
+		return strings.TrimSpace(v)
+	}
+	return parsed.String()
+}
+
+// versionBelow returns the version prefix right below v, 15.2 giving 15.1
+// and 15.0 giving 14, or "" when there is none
+func versionBelow(v string) string {
+	var segments []int
+	for _, s := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return ""
+		}
+		segments = append(segments, n)
+	}
+	for len(segments) > 0 && segments[len(segments)-1] == 0 {
+		segments = segments[:len(segments)-1]
+	}
+	if len(segments) == 0 {
+		return ""
+	}
+	segments[len(segments)-1]--
+	below := make([]string, len(segments))
+	for i, n := range segments {
+		below[i] = strconv.Itoa(n)
+	}
+	return strings.Join(below, ".")
+}
+
+// highestVersion returns the highest version the installer may install for
+// a version prefix, 14.10 standing for 14.10.x
+func highestVersion(prefix string) (*version.Version, error) {
+	v, err := version.NewVersion(prefix)
+	if err != nil {
+		return nil, err
+	}
+	segments := strings.Split(prefix, ".")
+	if v.Prerelease() != "" || len(segments) >= 3 {
+		return v, nil
+	}
+	for len(segments) < 3 {
+		segments = append(segments, strconv.Itoa(maxSegment))
+	}
+	return version.NewVersion(strings.Join(segments, "."))
+}
+
+// installedVersion returns the version of chef-client on the machine, or nil
+// when it is not installed
+func (p *provisioner) installedVersion(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) *version.Version {
+	var out string
+	var err error
+	if p.OSType == "windows" {
+		out, err = p.runRemoteOutput(ctx, o, comm, p.chefCmd+" --version")
+	} else {
+		out, err = p.runRemoteAsUserOutput(ctx, o, comm, p.chefCmd+" --version")
+	}
+	if err != nil {
+		log.Printf("Error getting the chef-client version: %v", err)
+		return nil
+	}
+	installed, err := parseChefVersion(out)
+	if err != nil {
+		log.Printf("Error parsing the chef-client version: %v", err)
+		return nil
+	}
+	return installed
+}
+
+// ensureChefClient installs chef-client unless the installed version already
+// satisfies version and version_policy, and checks the result of the install
+func (p *provisioner) ensureChefClient(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	if installed := p.installedVersion(ctx, o, comm); installed != nil {
+		satisfied, err := p.versionSatisfied(installed)
+		if err != nil {
+			return err
+		}
+		if satisfied {
+			o.Output(fmt.Sprintf("chef-client %s is already installed, skipping install", installed))
+			p.installedChef = installed
+			return nil
+		}
+		o.Output(fmt.Sprintf("chef-client %s does not satisfy version %s (%s), installing %s",
+			installed, p.Version, p.VersionPolicy, p.installVersion()))
+	}
+
+	if err := p.installChefClient(ctx, o, comm); err != nil {
+		return err
+	}
+	if anyVersion(p.Version) {
+		return nil
+	}
+
+	installed := p.installedVersion(ctx, o, comm)
+	if installed == nil {
+		return fmt.Errorf("chef-client is not available after the install")
+	}
+	satisfied, err := p.versionSatisfied(installed)
+	if err != nil {
+		return err
+	}
+	if !satisfied {
+		return fmt.Errorf("chef-client %s was installed, which does not satisfy version %s (%s)",
+			installed, p.Version, p.VersionPolicy)
+	}
+	p.installedChef = installed
+	return nil
+}
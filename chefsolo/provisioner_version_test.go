@@ -0,0 +1,203 @@
+package chefsolo
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestParseChefVersion(t *testing.T) {
+	cases := map[string]string{
+		"Chef: 14.10.9\n":                 "14.10.9",
+		"Chef Infra Client: 15.0.300\r\n": "15.0.300",
+		"Chef: 12.21\n":                   "12.21.0",
+	}
+	for out, expected := range cases {
+		v, err := parseChefVersion(out)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", out, err)
+		}
+		if v.String() != expected {
+			t.Fatalf("Test %q failed: expected %s, got %s", out, expected, v)
+		}
+	}
+	if _, err := parseChefVersion("command not found"); err == nil {
+		t.Fatalf("expected an output without version to fail")
+	}
+}
+
+func TestResourceProvider_versionSatisfied(t *testing.T) {
+	cases := map[string]struct {
+		Version   string
+		Policy    string
+		Installed string
+		Satisfied bool
+	}{
+		"any version":               {Version: "", Policy: versionPolicyExact, Installed: "12.0.3", Satisfied: true},
+		"latest":                    {Version: "latest", Policy: versionPolicyExact, Installed: "12.0.3", Satisfied: true},
+		"exact":                     {Version: "14.10.9", Policy: versionPolicyExact, Installed: "14.10.9", Satisfied: true},
+		"exact other patch":         {Version: "14.10.9", Policy: versionPolicyExact, Installed: "14.10.10", Satisfied: false},
+		"exact prefix":              {Version: "14.10", Policy: versionPolicyExact, Installed: "14.10.9", Satisfied: true},
+		"exact prefix other minor":  {Version: "14.10", Policy: versionPolicyExact, Installed: "14.11.0", Satisfied: false},
+		"exact major":               {Version: "14", Policy: versionPolicyExact, Installed: "14.11.0", Satisfied: true},
+		"minimum newer":             {Version: "14.10", Policy: versionPolicyMinimum, Installed: "15.0.300", Satisfied: true},
+		"minimum older":             {Version: "14.10", Policy: versionPolicyMinimum, Installed: "14.9.2", Satisfied: false},
+		"pessimistic constraint":    {Version: "~> 14.10", Policy: versionPolicyConstraint, Installed: "14.12.3", Satisfied: true},
+		"pessimistic too new":       {Version: "~> 14.10", Policy: versionPolicyConstraint, Installed: "15.0.300", Satisfied: false},
+		"range constraint":          {Version: ">= 13, < 15", Policy: versionPolicyConstraint, Installed: "14.1.0", Satisfied: true},
+		"range constraint too old":  {Version: ">= 13, < 15", Policy: versionPolicyConstraint, Installed: "12.22.5", Satisfied: false},
+		"exact constraint mismatch": {Version: "= 14.10.9", Policy: versionPolicyConstraint, Installed: "14.10.8", Satisfied: false},
+	}
+
+	for k, tc := range cases {
+		p := &provisioner{Version: tc.Version, VersionPolicy: tc.Policy}
+		satisfied, err := p.versionSatisfied(version.Must(version.NewVersion(tc.Installed)))
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if satisfied != tc.Satisfied {
+			t.Fatalf("Test %q failed: expected %t, got %t", k, tc.Satisfied, satisfied)
+		}
+	}
+}
+
+func TestResourceProvider_installVersion(t *testing.T) {
+	cases := map[string]struct {
+		Version  string
+		Policy   string
+		Expected string
+	}{
+		"exact":             {Version: "14.10.9", Policy: versionPolicyExact, Expected: "14.10.9"},
+		"minimum":           {Version: "14.10", Policy: versionPolicyMinimum, Expected: "14.10"},
+		"pessimistic minor": {Version: "~> 14.10", Policy: versionPolicyConstraint, Expected: "14"},
+		"pessimistic patch": {Version: "~> 14.10.2", Policy: versionPolicyConstraint, Expected: "14.10"},
+		"equal":             {Version: "= 14.10.9", Policy: versionPolicyConstraint, Expected: "14.10.9"},
+		"equal short":       {Version: "= 14.10", Policy: versionPolicyConstraint, Expected: "14.10.0"},
+		"range":             {Version: ">= 13, < 15", Policy: versionPolicyConstraint, Expected: "14"},
+		"range minor":       {Version: ">= 14.5, < 14.12", Policy: versionPolicyConstraint, Expected: "14.11"},
+		"range patch":       {Version: "> 14.10.0, < 14.10.5", Policy: versionPolicyConstraint, Expected: "14.10.4"},
+		"inclusive range":   {Version: ">= 13, <= 14.10", Policy: versionPolicyConstraint, Expected: "14.10.0"},
+		"tightest bound":    {Version: "~> 14.10, < 14.12", Policy: versionPolicyConstraint, Expected: "14.11"},
+		"lower bound":       {Version: ">= 14.10", Policy: versionPolicyConstraint, Expected: versionLatest},
+	}
+
+	for k, tc := range cases {
+		p := &provisioner{Version: tc.Version, VersionPolicy: tc.Policy}
+		if v := p.installVersion(); v != tc.Expected {
+			t.Fatalf("Test %q failed: expected %q, got %q", k, tc.Expected, v)
+		}
+	}
+}
+
+func TestResourceProvider_ensureChefClient(t *testing.T) {
+	cases := map[string]struct {
+		Config    map[string]interface{}
+		Installed string
+		After     string
+		Install   bool
+		Error     bool
+	}{
+		"not installed": {
+			Config:  map[string]interface{}{"version": "14.10"},
+			After:   "Chef: 14.10.9",
+			Install: true,
+		},
+		"already installed": {
+			Config:    map[string]interface{}{"version": "14.10"},
+			Installed: "Chef: 14.10.9",
+			Install:   false,
+		},
+		"any version installed": {
+			Config:    map[string]interface{}{},
+			Installed: "Chef: 12.0.3",
+			Install:   false,
+		},
+		"downgrade": {
+			Config:    map[string]interface{}{"version": "14.10"},
+			Installed: "Chef: 15.0.300",
+			After:     "Chef: 14.10.9",
+			Install:   true,
+		},
+		"minimum met": {
+			Config:    map[string]interface{}{"version": "14.10", "version_policy": "minimum"},
+			Installed: "Chef: 15.0.300",
+			Install:   false,
+		},
+		"constraint upgrade": {
+			Config:    map[string]interface{}{"version": "~> 14.10", "version_policy": "constraint"},
+			Installed: "Chef: 13.12.14",
+			After:     "Chef Infra Client: 14.15.6",
+			Install:   true,
+		},
+		"install does not satisfy": {
+			Config:    map[string]interface{}{"version": "~> 14.10", "version_policy": "constraint"},
+			Installed: "Chef: 13.12.14",
+			After:     "Chef: 15.0.300",
+			Install:   true,
+			Error:     true,
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+
+		installed := tc.Installed
+		install := false
+		p.installChefClient = func(context.Context, terraform.UIOutput, communicator.Communicator) error {
+			install = true
+			installed = tc.After
+			return nil
+		}
+		c := new(communicator.MockCommunicator)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			if cmd.Command != linuxChefCmd+" --version" {
+				t.Fatalf("Test %q failed: unexpected command %q", k, cmd.Command)
+			}
+			if installed == "" {
+				cmd.SetExitStatus(127, nil)
+				return nil
+			}
+			io.WriteString(cmd.Stdout, installed+"\n")
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		err = p.ensureChefClient(context.Background(), o, c)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if install != tc.Install {
+			t.Fatalf("Test %q failed: expected install %t, got %t", k, tc.Install, install)
+		}
+	}
+}
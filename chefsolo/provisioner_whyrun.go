@@ -0,0 +1,125 @@
+package chefsolo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+const whyRunDir = "why-run"
+
+var (
+	whyRunRecipe   = regexp.MustCompile(`^\s*Recipe: (\S+)`)
+	whyRunResource = regexp.MustCompile(`^\s*\* (\S+\[.*\]) action (\w+)`)
+	whyRunChange   = regexp.MustCompile(`^\s*- ((?i:would) .*)`)
+)
+
+// pendingChange lists what chef-client would do to a resource
+type pendingChange struct {
+	Recipe   string   `json:"recipe,omitempty"`
+	Resource string   `json:"resource"`
+	Action   string   `json:"action"`
+	Changes  []string `json:"changes"`
+}
+
+// whyRunReport is the summary of a why-run written under output_dir
+type whyRunReport struct {
+	InstanceID     string           `json:"instance_id"`
+	BundleID       string           `json:"bundle_id"`
+	Time           string           `json:"time"`
+	PendingChanges int              `json:"pending_changes"`
+	Resources      []*pendingChange `json:"resources"`
+}
+
+// whyRunOutput passes the output of chef-client through, collecting the
+// "Would ..." lines of each resource
+type whyRunOutput struct {
+	terraform.UIOutput
+	mu        sync.Mutex
+	recipe    string
+	resource  string
+	action    string
+	current   *pendingChange
+	resources []*pendingChange
+}
+
+// Output implementation of terraform.UIOutput interface
+func (o *whyRunOutput) Output(output string) {
+	o.UIOutput.Output(output)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, line := range strings.Split(ansiEscape.ReplaceAllString(output, ""), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if m := whyRunRecipe.FindStringSubmatch(line); m != nil {
+			o.recipe = m[1]
+			continue
+		}
+		if m := whyRunResource.FindStringSubmatch(line); m != nil {
+			o.resource, o.action, o.current = m[1], m[2], nil
+			continue
+		}
+		if m := whyRunChange.FindStringSubmatch(line); m != nil && o.resource != "" {
+			// Only the resources with changes make it to the report
+			if o.current == nil {
+				o.current = &pendingChange{Recipe: o.recipe, Resource: o.resource, Action: o.action}
+				o.resources = append(o.resources, o.current)
+			}
+			o.current.Changes = append(o.current.Changes, m[1])
+		}
+	}
+}
+
+// whyRunReportFile returns the local path of the why-run report of the
+// instance. It is kept out of the workspace of the apply, which is removed
+// by a later apply and whose bundle is uploaded to the machines.
+func (p *provisioner) whyRunReportFile() string {
+	return path.Join(p.outputRoot, whyRunDir, p.InstanceId+".json")
+}
+
+// runWhyRun runs chef-client with --why-run and writes the changes it would
+// make to a report under output_dir. It only fails on pending changes with
+// fail_on_pending_changes.
+func (p *provisioner) runWhyRun(ctx context.Context, o terraform.UIOutput, comm communicator.Communicator) error {
+	w := &whyRunOutput{UIOutput: o}
+	if err := p.runChefClient(ctx, w, comm); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	report := whyRunReport{
+		InstanceID:     p.InstanceId,
+		BundleID:       p.BundleID,
+		Time:           time.Now().UTC().Format(time.RFC3339),
+		PendingChanges: len(w.resources),
+		Resources:      append([]*pendingChange{}, w.resources...),
+	}
+	w.mu.Unlock()
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error rendering the why-run report: %v", err)
+	}
+	reportFile := p.whyRunReportFile()
+	if err := p.os.MkdirAll(path.Dir(reportFile), 0755); err != nil {
+		return fmt.Errorf("error creating the why-run report directory: %v", err)
+	}
+	if err := afero.WriteFile(p.os, reportFile, content, 0644); err != nil {
+		return fmt.Errorf("error writing the why-run report %s: %v", reportFile, err)
+	}
+
+	o.Output(fmt.Sprintf("chef-client would change %d resources, see %s", report.PendingChanges, reportFile))
+	if p.FailOnPendingChanges && report.PendingChanges > 0 {
+		return fmt.Errorf("%d resources have pending changes, see %s", report.PendingChanges, reportFile)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package chefsolo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_runWhyRun(t *testing.T) {
+	const pending = "Starting Chef Client, version 14.12.9\r\n" +
+		"Recipe: base::default\n" +
+		"  * apt_update[update] action periodic (up to date)\n" +
+		"  * package[curl] action install\n" +
+		"    - Would install version 7.58.0 of package curl\n" +
+		"  * \x1b[32mtemplate[/etc/motd]\x1b[0m action create\n" +
+		"    - would update content in file /etc/motd from 3a4f to 9bc1\n" +
+		"    --- /etc/motd\n" +
+		"    +++ /etc/.chef-motd\n" +
+		"    - would change mode from '0600' to '0644'\n" +
+		"Recipe: web::default\n" +
+		"  * service[nginx] action restart\n" +
+		"    - Would restart service service[nginx]\n" +
+		"Chef Client finished, 3/12 resources would have been updated\n"
+	// With log_level :info in client.rb, the log lines of chef-client are
+	// written along with the doc formatter
+	const logged = "[2026-10-17T09:12:03+00:00] INFO: Started Chef Infra Client Run\n" +
+		"Recipe: base::default\n" +
+		"[2026-10-17T09:12:04+00:00] INFO: Processing package[curl] action install (base::default line 3)\n" +
+		"  * package[curl] action install\n" +
+		"[2026-10-17T09:12:04+00:00] INFO: package[curl] would install version 7.58.0\n" +
+		"    - Would install version 7.58.0 of package curl\n" +
+		"[2026-10-17T09:12:05+00:00] INFO: Processing service[nginx] action restart (web::default line 8)\n" +
+		"[2026-10-17T09:12:05+00:00] WARN: - would restart service[nginx]\n" +
+		"  * service[nginx] action restart (up to date)\n" +
+		"[2026-10-17T09:12:05+00:00] INFO: Chef Infra Client Run complete in 2.1 seconds\n"
+	const upToDate = "Starting Chef Client, version 14.12.9\n" +
+		"Recipe: base::default\n" +
+		"  * package[curl] action install (up to date)\n" +
+		"Chef Client finished, 0/12 resources would have been updated\n"
+
+	cases := map[string]struct {
+		Config    map[string]interface{}
+		Output    string
+		Resources []*pendingChange
+		Error     bool
+	}{
+		"Pending changes": {
+			Output: pending,
+			Resources: []*pendingChange{
+				{"base::default", "package[curl]", "install", []string{"Would install version 7.58.0 of package curl"}},
+				{"base::default", "template[/etc/motd]", "create", []string{
+					"would update content in file /etc/motd from 3a4f to 9bc1",
+					"would change mode from '0600' to '0644'",
+				}},
+				{"web::default", "service[nginx]", "restart", []string{"Would restart service service[nginx]"}},
+			},
+		},
+		"Log lines": {
+			Output: logged,
+			Resources: []*pendingChange{
+				{"base::default", "package[curl]", "install", []string{"Would install version 7.58.0 of package curl"}},
+			},
+		},
+		"Up to date": {
+			Output:    upToDate,
+			Resources: []*pendingChange{},
+		},
+		"Fail on pending changes": {
+			Config: map[string]interface{}{"fail_on_pending_changes": true},
+			Output: pending,
+			Resources: []*pendingChange{
+				{"base::default", "package[curl]", "install", []string{"Would install version 7.58.0 of package curl"}},
+				{"base::default", "template[/etc/motd]", "create", []string{
+					"would update content in file /etc/motd from 3a4f to 9bc1",
+					"would change mode from '0600' to '0644'",
+				}},
+				{"web::default", "service[nginx]", "restart", []string{"Would restart service service[nginx]"}},
+			},
+			Error: true,
+		},
+		"Fail on pending changes when up to date": {
+			Config:    map[string]interface{}{"fail_on_pending_changes": true},
+			Output:    upToDate,
+			Resources: []*pendingChange{},
+		},
+	}
+
+	o := new(terraform.MockUIOutput)
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"bundle_id":        "app",
+			"why_run":          true,
+		}
+		for key, v := range tc.Config {
+			config[key] = v
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		if err := p.configurePerOS(&terraform.InstanceState{Ephemeral: terraform.EphemeralState{ConnInfo: map[string]string{}}}); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		// As set by joinWorkspace
+		p.OutputDir = path.Join("/output", generationPrefix+"1", p.BaseOutputDir)
+
+		whyRun := false
+		c := new(communicator.MockCommunicator)
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			whyRun = strings.HasSuffix(cmd.Command, " -E _default --why-run --force-formatter -F doc")
+			io.WriteString(cmd.Stdout, tc.Output)
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		err := p.runWhyRun(context.Background(), o, c)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if !whyRun {
+			t.Fatalf("Test %q failed: chef-client was not run with --why-run and the doc formatter", k)
+		}
+
+		content, err := afero.ReadFile(fs, "/output/why-run/toto.json")
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		var report whyRunReport
+		if err := json.Unmarshal(content, &report); err != nil {
+			t.Fatalf("Test %q failed: %v", k, err)
+		}
+		if report.InstanceID != "toto" || report.BundleID != "app" || report.PendingChanges != len(tc.Resources) {
+			t.Fatalf("Test %q failed: unexpected report:\n%s", k, content)
+		}
+		if !reflect.DeepEqual(report.Resources, tc.Resources) {
+			t.Fatalf("Test %q failed: unexpected pending changes:\n%s", k, content)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package chefsolo
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"strings"
@@ -9,6 +10,15 @@ import (
 	"github.com/hashicorp/terraform/terraform"
 )
 
+const (
+	// secretStagingDir is where the data bag secret is uploaded before being
+	// moved into the config directory
+	secretStagingDir = "secret.tmp"
+	// The well-known SIDs of the Administrators group and of SYSTEM
+	windowsAdministrators = "*S-1-5-32-544"
+	windowsSystem         = "*S-1-5-18"
+)
+
 const installScript = `
 $winver = [System.Environment]::OSVersion.Version | %% {"{0}.{1}" -f $_.Major,$_.Minor}
 
@@ -23,14 +33,18 @@ switch ($winver)
 
 if ([System.IntPtr]::Size -eq 4) {$machine_arch = "i686"} else {$machine_arch = "x86_64"}
 
-$url = "http://omnitruck.chef.io/%s/chef/download?p=windows&pv=$machine_os&m=$machine_arch&v=%s"
+$omnitruck = %s
+$product = %s
+$channel = %s
+$version = %s
+$url = "$omnitruck/$channel/$product/download?p=windows&pv=$machine_os&m=$machine_arch&v=$version"
 $dest = [System.IO.Path]::GetTempFileName()
 $dest = [System.IO.Path]::ChangeExtension($dest, ".msi")
 $downloader = New-Object System.Net.WebClient
 
-$http_proxy = '%s'
+$http_proxy = %s
 if ($http_proxy -ne '') {
-	$no_proxy = '%s'
+	$no_proxy = %s
   if ($no_proxy -eq ''){
     $no_proxy = "127.0.0.1"
   }
@@ -46,9 +60,65 @@ Write-Host 'Installing Chef Client...'
 Start-Process -FilePath msiexec -ArgumentList /qn, /i, $dest -Wait
 `
 
-func (p *provisioner) windowsInstallChefClient(o terraform.UIOutput, comm communicator.Communicator) error {
+const expandScript = `
+$ErrorActionPreference = 'Stop'
+$archive = %s
+$dest = %s
+$expected = %s
+$deleted = @(%s)
+
+$stream = [System.IO.File]::OpenRead($archive)
+try {
+  $hash = [System.Security.Cryptography.SHA256]::Create().ComputeHash($stream)
+} finally {
+  $stream.Close()
+}
+$actual = ([System.BitConverter]::ToString($hash) -replace '-', '').ToLower()
+if ($actual -ne $expected) {
+  Remove-Item -Force $archive
+  throw "Checksum mismatch for ${archive}: expected $expected, got $actual"
+}
+
+if (Get-Command Expand-Archive -ErrorAction SilentlyContinue) {
+  Expand-Archive -Path $archive -DestinationPath $dest -Force
+} else {
+  # PowerShell older than 5.0, ZipFile.ExtractToDirectory can not overwrite
+  Add-Type -AssemblyName System.IO.Compression.FileSystem
+  $zip = [System.IO.Compression.ZipFile]::OpenRead($archive)
+  try {
+    foreach ($entry in $zip.Entries) {
+      $target = [System.IO.Path]::Combine($dest, $entry.FullName)
+      if ($entry.FullName.EndsWith('/')) {
+        [System.IO.Directory]::CreateDirectory($target) | Out-Null
+      } else {
+        [System.IO.Directory]::CreateDirectory([System.IO.Path]::GetDirectoryName($target)) | Out-Null
+        [System.IO.Compression.ZipFileExtensions]::ExtractToFile($entry, $target, $true)
+      }
+    }
+  } finally {
+    $zip.Dispose()
+  }
+}
+
+Remove-Item -Force $archive
+
+foreach ($file in $deleted) {
+  if (Test-Path -LiteralPath $file) {
+    Remove-Item -Force -LiteralPath $file
+  }
+}
+`
+
+func (p *provisioner) windowsInstallChefClient(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
 	script := path.Join(path.Dir(comm.ScriptPath()), "ChefClient.ps1")
-	content := fmt.Sprintf(installScript, p.Channel, p.Version, p.HTTPProxy, strings.Join(p.NOProxy, ","))
+	content := fmt.Sprintf(installScript,
+		powershellQuote(strings.TrimSuffix(p.dist.Omnitruck, "/")),
+		powershellQuote(p.dist.Product),
+		powershellQuote(p.Channel),
+		powershellQuote(p.installVersion()),
+		powershellQuote(p.HTTPProxy),
+		powershellQuote(strings.Join(p.NOProxy, ",")))
 
 	// Copy the script to the new instance
 	if err := comm.UploadScript(script, strings.NewReader(content)); err != nil {
@@ -56,35 +126,146 @@ func (p *provisioner) windowsInstallChefClient(o terraform.UIOutput, comm commun
 	}
 
 	// Execute the script to install Chef Client
-	installCmd := fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File %s", script)
-	return p.runRemote(o, comm, installCmd)
+	installCmd := fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File %s", cmdQuote(script))
+	return p.runRemote(ctx, o, comm, installCmd)
 }
 
-func (p *provisioner) windowsUploadConfigFiles(o terraform.UIOutput, comm communicator.Communicator) error {
+func (p *provisioner) windowsUploadConfigFiles(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
 	// Make sure the config directory exists
-	cmd := fmt.Sprintf("cmd /c if not exist %q mkdir %q", windowsConfDir, windowsConfDir)
-	if err := p.runRemote(o, comm, cmd); err != nil {
+	cmd := fmt.Sprintf("cmd /c if not exist %s mkdir %s", cmdQuote(p.DefaultConfDir), cmdQuote(p.DefaultConfDir))
+	if err := p.runRemote(ctx, o, comm, cmd); err != nil {
 		return err
 	}
 
 	o.Output("Uploading client conf")
-	if err := p.uploadClientConf(comm, windowsConfDir); err != nil {
+	if err := p.uploadClientConf(comm, p.DefaultConfDir); err != nil {
 		return err
 	}
 
-	configDir := path.Join(windowsConfDir, p.BaseOutputDir)
-	cmd = fmt.Sprintf("cmd /c if not exist %q mkdir %q", configDir, configDir)
-	if err := p.runRemote(o, comm, cmd); err != nil {
+	configDir := path.Join(p.DefaultConfDir, p.BaseOutputDir)
+	cmd = fmt.Sprintf("cmd /c if not exist %s mkdir %s", cmdQuote(configDir), cmdQuote(configDir))
+	if err := p.runRemote(ctx, o, comm, cmd); err != nil {
 		return err
 	}
 
-	if err := p.uploadDirectory(o, comm, p.OutputDir, windowsConfDir); err != nil {
+	if p.UploadMode == uploadModeArchive || p.UploadMode == uploadModeSync {
+		if err := p.windowsUploadArchive(ctx, o, comm); err != nil {
+			return err
+		}
+	} else {
+		if err := p.uploadDirectory(o, comm, p.OutputDir, p.DefaultConfDir); err != nil {
+			return err
+		}
+
+		for _, resource := range p.Resources {
+			if err := p.uploadDirectory(o, comm, resource.(string), path.Join(p.DefaultConfDir, p.BaseOutputDir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := p.windowsUploadSecretKey(ctx, o, comm); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (p *provisioner) windowsInstallChefAsAService(o terraform.UIOutput, comm communicator.Communicator, str string) error {
+// windowsUploadArchive uploads the bundle as a single zip file and extracts
+// it within the config directory once its checksum is verified
+func (p *provisioner) windowsUploadArchive(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	entries := p.archiveEntries(o)
+	var sync *bundleSync
+	if p.UploadMode == uploadModeSync {
+		manifestPath := cmdQuote(path.Join(p.DefaultConfDir, p.BaseOutputDir, manifestFile))
+		readCmd := fmt.Sprintf("cmd /c if exist %s type %s", manifestPath, manifestPath)
+		var err error
+		if sync, err = p.prepareSync(ctx, o, comm, readCmd, entries); err != nil {
+			return err
+		}
+	}
+
+	f, sum, err := p.createArchive(entries, sync)
+	if err != nil {
+		return err
+	}
+	defer p.removeArchive(f)
+
+	archive := path.Join(p.DefaultConfDir, p.BaseOutputDir+p.archiveExtension())
+	o.Output(fmt.Sprintf("Uploading %s (sha256 %s)", archive, sum))
+	if err := comm.Upload(archive, f); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", archive, err)
+	}
+
+	script := path.Join(path.Dir(comm.ScriptPath()), "ExpandBundle.ps1")
+	var deleted []string
+	if sync != nil {
+		for _, file := range sync.deleted {
+			deleted = append(deleted, powershellQuote(path.Join(p.DefaultConfDir, p.BaseOutputDir, file)))
+		}
+	}
+	content := fmt.Sprintf(expandScript, powershellQuote(archive), powershellQuote(p.DefaultConfDir), powershellQuote(sum),
+		strings.Join(deleted, ", "))
+	if err := comm.UploadScript(script, strings.NewReader(content)); err != nil {
+		return fmt.Errorf("uploading ExpandBundle.ps1 failed: %v", err)
+	}
+
+	cmd := fmt.Sprintf("powershell -NoProfile -ExecutionPolicy Bypass -File %s", cmdQuote(script))
+	if err := p.runRemote(ctx, o, comm, cmd); err != nil {
+		return fmt.Errorf("extracting %s failed: %v", archive, err)
+	}
+	return nil
+}
+
+func (p *provisioner) windowsUploadSecretKey(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator) error {
+	if p.SecretKey == "" {
+		return nil
+	}
+	o.Output("Uploading encrypted data bag secret")
+	// The secret is uploaded into a directory only the Administrators group
+	// and SYSTEM can access, so it is never readable with the inherited ACL
+	// of the config directory, then moved into place
+	staging := path.Join(p.DefaultConfDir, secretStagingDir)
+	secretPath := path.Join(p.DefaultConfDir, secretKey)
+	if err := p.runMultipleCommands(ctx, o, comm, []string{
+		fmt.Sprintf("cmd /c if exist %s rmdir /s /q %s", cmdQuote(staging), cmdQuote(staging)),
+		fmt.Sprintf("cmd /c mkdir %s", cmdQuote(staging)),
+		fmt.Sprintf("cmd /c icacls %s /inheritance:r /grant:r %s %s", cmdQuote(staging),
+			cmdQuote(windowsAdministrators+":(OI)(CI)F"), cmdQuote(windowsSystem+":(OI)(CI)F")),
+	}); err != nil {
+		return fmt.Errorf("error creating %s: %v", staging, err)
+	}
+	defer func() {
+		if err := p.runRemote(ctx, o, comm, fmt.Sprintf("cmd /c rmdir /s /q %s", cmdQuote(staging))); err != nil {
+			o.Output(fmt.Sprintf("Warning: removing %s failed: %v", staging, err))
+		}
+	}()
+
+	staged := path.Join(staging, secretKey)
+	if err := comm.Upload(staged, strings.NewReader(p.SecretKey)); err != nil {
+		return fmt.Errorf("uploading %s failed: %v", secretKey, err)
+	}
+	move := fmt.Sprintf("cmd /c move /y %s %s", cmdQuote(staged), cmdQuote(secretPath))
+	if err := p.runRemote(ctx, o, comm, move); err != nil {
+		return fmt.Errorf("installing %s failed: %v", secretKey, err)
+	}
+	// A moved file keeps the entries it inherited from the staging directory
+	// until its ACL is rewritten, they are made explicit right away
+	cmd := fmt.Sprintf("cmd /c icacls %s /inheritance:r /grant:r %s %s", cmdQuote(secretPath),
+		cmdQuote(windowsAdministrators+":F"), cmdQuote(windowsSystem+":F"))
+	if err := p.runRemote(ctx, o, comm, cmd); err != nil {
+		if err := p.runRemote(ctx, o, comm, fmt.Sprintf("cmd /c del /f /q %s", cmdQuote(secretPath))); err != nil {
+			o.Output(fmt.Sprintf("Warning: removing %s failed: %v", secretPath, err))
+		}
+		return fmt.Errorf("restricting access to %s failed: %v", secretKey, err)
+	}
+	return nil
+}
+
+func (p *provisioner) windowsInstallChefAsAService(ctx context.Context, o terraform.UIOutput,
+	comm communicator.Communicator, str string) error {
 	return nil
 }
@@ -0,0 +1,87 @@
+package chefsolo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/communicator"
+	"github.com/hashicorp/terraform/communicator/remote"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+)
+
+func TestResourceProvider_windowsUploadSecretKey(t *testing.T) {
+	const (
+		staging  = windowsConfDir + "/secret.tmp"
+		secret   = windowsConfDir + "/encrypted_data_bag_secret"
+		restrict = `cmd /c icacls ` + secret + ` /inheritance:r /grant:r "*S-1-5-32-544:F" "*S-1-5-18:F"`
+	)
+	prepare := []string{
+		"cmd /c if exist " + staging + " rmdir /s /q " + staging,
+		"cmd /c mkdir " + staging,
+		`cmd /c icacls ` + staging + ` /inheritance:r /grant:r "*S-1-5-32-544:(OI)(CI)F" "*S-1-5-18:(OI)(CI)F"`,
+	}
+
+	cases := map[string]struct {
+		FailRestrict bool
+		Commands     []string
+		Error        bool
+	}{
+		"Restricted": {
+			Commands: append(append([]string{}, prepare...),
+				"cmd /c move /y "+staging+"/encrypted_data_bag_secret "+secret,
+				restrict,
+				"cmd /c rmdir /s /q "+staging,
+			),
+		},
+		"Restricting fails": {
+			FailRestrict: true,
+			Commands: append(append([]string{}, prepare...),
+				"cmd /c move /y "+staging+"/encrypted_data_bag_secret "+secret,
+				restrict,
+				"cmd /c del /f /q "+secret,
+				"cmd /c rmdir /s /q "+staging,
+			),
+			Error: true,
+		},
+	}
+
+	for k, tc := range cases {
+		config := map[string]interface{}{
+			"instance_id":      `toto`,
+			"chef_module_path": `/input`,
+			"output_dir":       `/output`,
+			"nodes":            []string{`{ "id":"toto"}`},
+			"target_node":      `{ "id":"toto"}`,
+			"secret_key":       "s3cr3t",
+		}
+		fs := afero.NewMemMapFs()
+		fs.MkdirAll("/input", 0766)
+		p := testProvisioner(t, fs, config)
+		p.OSType = "windows"
+		p.DefaultConfDir = windowsConfDir
+
+		var commands []string
+		c := new(communicator.MockCommunicator)
+		c.Uploads = map[string]string{staging + "/encrypted_data_bag_secret": "s3cr3t"}
+		c.CommandFunc = func(cmd *remote.Cmd) error {
+			commands = append(commands, cmd.Command)
+			if cmd.Command == restrict && tc.FailRestrict {
+				return fmt.Errorf("access denied")
+			}
+			cmd.SetExitStatus(0, nil)
+			return nil
+		}
+
+		err := p.windowsUploadSecretKey(context.Background(), new(terraform.MockUIOutput), c)
+		if (err != nil) != tc.Error {
+			t.Fatalf("Test %q failed: expected error %t, got %v", k, tc.Error, err)
+		}
+		if strings.Join(commands, "\n") != strings.Join(tc.Commands, "\n") {
+			t.Fatalf("Test %q failed: expected:\n%s\ngot:\n%s", k, strings.Join(tc.Commands, "\n"),
+				strings.Join(commands, "\n"))
+		}
+	}
+}
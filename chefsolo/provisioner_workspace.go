@@ -0,0 +1,147 @@
+package chefsolo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+	"github.com/theckman/go-flock"
+)
+
+const (
+	workspaceLockFile  = "workspace.lock"
+	generationPrefix   = "gen-"
+	generationLockFile = "in-use.lock"
+	generationApply    = "apply"
+)
+
+// applyProcess identifies the apply running the provisioner: every instance
+// of an apply is provisioned from a plugin started by the same terraform
+// process
+var applyProcess = os.Getppid
+
+// joinWorkspace points the output directory to the generation of the current
+// apply. The first instance creates a new generation, the ones of the same
+// apply running while it is still held join it, and the generations nobody
+// holds any more are removed. Each generation contains a directory named
+// after output_dir so the bundle keeps the same name on the machine.
+// The returned func releases the generation once the instance is done with it.
+func (p *provisioner) joinWorkspace(ctx context.Context, o terraform.UIOutput) (func(), error) {
+	wsLock := flock.NewFlock(path.Join(p.outputRoot, workspaceLockFile))
+	if _, err := wsLock.TryLockContext(ctx, 100*time.Millisecond); err != nil {
+		return nil, fmt.Errorf("error locking workspace %s: %v", p.outputRoot, err)
+	}
+	defer wsLock.Unlock()
+
+	apply := p.applyKey()
+	generation := p.heldGeneration(apply)
+	if generation == "" {
+		generation = generationPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := p.os.MkdirAll(path.Join(p.outputRoot, generation, p.BaseOutputDir), 0766); err != nil {
+			return nil, fmt.Errorf("error creating workspace %s: %v", generation, err)
+		}
+		applyFile := path.Join(p.outputRoot, generation, generationApply)
+		if err := afero.WriteFile(p.os, applyFile, []byte(apply+"\n"), 0644); err != nil {
+			return nil, fmt.Errorf("error writing %s: %v", applyFile, err)
+		}
+		o.Output("Created workspace " + generation)
+	} else {
+		o.Output("Joined workspace " + generation)
+	}
+
+	// Holding a shared lock on the generation keeps it from being collected,
+	// and tells the instances to come that this apply is still running
+	inUse := flock.NewFlock(path.Join(p.outputRoot, generation, generationLockFile))
+	if locked, err := inUse.TryRLock(); err != nil || !locked {
+		return nil, fmt.Errorf("error holding workspace %s: %v", generation, err)
+	}
+
+	p.collectGenerations(o, generation)
+
+	p.OutputDir = path.Join(p.outputRoot, generation, p.BaseOutputDir)
+	return func() { inUse.Unlock() }, nil
+}
+
+// applyKey identifies the apply along with the configuration the bundle is
+// made of, so an instance only joins the generation of its own apply
+func (p *provisioner) applyKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "process %d\x00", applyProcess())
+	fmt.Fprintf(h, "module %s\x00policyfile %t\x00", p.ChefModulePath, p.UsePolicyfile)
+	for _, command := range p.getBundleCommand(bundleOutputToken) {
+		fmt.Fprintf(h, "command %s\x00", command)
+	}
+	for _, node := range p.Nodes {
+		fmt.Fprintf(h, "node %s\x00", node)
+	}
+	for _, resource := range p.Resources {
+		fmt.Fprintf(h, "resource %s\x00", resource)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// heldGeneration returns the generation of the apply still held by one of
+// its instances, or an empty string when a new one must be created
+func (p *provisioner) heldGeneration(apply string) string {
+	entries, err := afero.ReadDir(p.os, p.outputRoot)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		generation := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(generation, generationPrefix) {
+			continue
+		}
+		b, err := afero.ReadFile(p.os, path.Join(p.outputRoot, generation, generationApply))
+		if err != nil || strings.TrimSpace(string(b)) != apply {
+			continue
+		}
+		if _, err := p.os.Stat(path.Join(p.outputRoot, generation, p.BaseOutputDir)); err != nil {
+			continue
+		}
+
+		// Getting the exclusive lock means nobody holds the generation
+		lock := flock.NewFlock(path.Join(p.outputRoot, generation, generationLockFile))
+		if locked, err := lock.TryLock(); err == nil && locked {
+			lock.Unlock()
+			continue
+		}
+		return generation
+	}
+	return ""
+}
+
+// collectGenerations removes the generations other than current that no
+// instance holds any more
+func (p *provisioner) collectGenerations(o terraform.UIOutput, current string) {
+	entries, err := afero.ReadDir(p.os, p.outputRoot)
+	if err != nil {
+		log.Printf("Error listing workspaces in %s: %v", p.outputRoot, err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, generationPrefix) || name == current {
+			continue
+		}
+		lock := flock.NewFlock(path.Join(p.outputRoot, name, generationLockFile))
+		if locked, err := lock.TryLock(); err != nil || !locked {
+			continue
+		}
+		if err := p.os.RemoveAll(path.Join(p.outputRoot, name)); err != nil {
+			log.Printf("Error removing workspace %s: %v", name, err)
+		} else {
+			o.Output("Removed workspace " + name)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,122 @@
+package chefsolo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/spf13/afero"
+	"github.com/theckman/go-flock"
+)
+
+func TestResourceProvider_joinWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-test")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs := afero.NewOsFs()
+	defer fs.RemoveAll(dir)
+	fs.MkdirAll(filepath.Join(dir, "input"), 0777)
+
+	config := map[string]interface{}{
+		"instance_id":      `toto`,
+		"chef_module_path": filepath.Join(dir, "input"),
+		"output_dir":       filepath.Join(dir, "output"),
+		"nodes":            []string{`{ "id":"toto"}`},
+		"target_node":      `{ "id":"toto"}`,
+	}
+	join := func() (*provisioner, func()) {
+		p, err := configureProvisioner(
+			schema.TestResourceDataRaw(t, Provisioner().(*schema.Provisioner).Schema, config),
+			fs,
+		)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		release, err := p.joinWorkspace(context.Background(), new(terraform.MockUIOutput))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return p, release
+	}
+
+	first, releaseFirst := join()
+	if path.Base(first.OutputDir) != "output" || !strings.HasPrefix(path.Base(path.Dir(first.OutputDir)), generationPrefix) {
+		t.Fatalf("expected the workspace to be output/%s*/output, got %s", generationPrefix, first.OutputDir)
+	}
+	fs.MkdirAll(path.Join(first.OutputDir, "nodes"), 0777)
+	afero.WriteFile(fs, path.Join(first.OutputDir, "nodes", "toto.json"), []byte(`{ "id":"toto"}`), 0644)
+
+	// An instance of the same apply joins the generation without wiping it
+	second, releaseSecond := join()
+	if second.OutputDir != first.OutputDir {
+		t.Fatalf("expected to join %s, got %s", first.OutputDir, second.OutputDir)
+	}
+	if _, err := fs.Stat(path.Join(first.OutputDir, "nodes", "toto.json")); err != nil {
+		t.Fatalf("joining the workspace must not remove its files: %v", err)
+	}
+
+	// An apply running at the same time never joins it, nor does an
+	// instance bundling other nodes
+	defer func(f func() int) { applyProcess = f }(applyProcess)
+	applyProcess = func() int { return -1 }
+	other, releaseOther := join()
+	applyProcess = os.Getppid
+	config["nodes"] = []string{`{ "id":"toto"}`, `{ "id":"titi"}`}
+	otherNodes, releaseOtherNodes := join()
+	config["nodes"] = []string{`{ "id":"toto"}`}
+	for _, p := range []*provisioner{other, otherNodes} {
+		if p.OutputDir == first.OutputDir {
+			t.Fatalf("expected a workspace of its own, got %s", p.OutputDir)
+		}
+	}
+	releaseOther()
+	releaseOtherNodes()
+
+	// Once nobody holds it, the next apply starts over and collects it
+	releaseFirst()
+	releaseSecond()
+	third, releaseThird := join()
+	defer releaseThird()
+	if third.OutputDir == first.OutputDir {
+		t.Fatalf("expected a new workspace, got %s again", third.OutputDir)
+	}
+	if _, err := fs.Stat(path.Dir(first.OutputDir)); err == nil {
+		t.Fatalf("expected %s to be collected", path.Dir(first.OutputDir))
+	}
+}
+
+func TestResourceProvider_collectGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-test")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs := afero.NewOsFs()
+	defer fs.RemoveAll(dir)
+
+	p := &provisioner{os: fs, outputRoot: dir, BaseOutputDir: "output"}
+	for _, d := range []string{"gen-1/output", "gen-2/output", "logfiles"} {
+		fs.MkdirAll(filepath.Join(dir, d), 0777)
+	}
+
+	// gen-1 is still held by a running instance
+	lock := flock.NewFlock(filepath.Join(dir, "gen-1", generationLockFile))
+	if locked, err := lock.TryRLock(); err != nil || !locked {
+		t.Fatalf("Error: %v", err)
+	}
+	defer lock.Unlock()
+
+	p.collectGenerations(new(terraform.MockUIOutput), "gen-3")
+
+	for name, exists := range map[string]bool{"gen-1": true, "gen-2": false, "logfiles": true} {
+		if _, err := fs.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Fatalf("expected %s to exist: %t", name, exists)
+		}
+	}
+}